@@ -6,8 +6,10 @@ multirun definition
 load("@bazel_skylib//lib:shell.bzl", "shell")
 load(
     "//internal:constants.bzl",
+    "BinaryArgsEnvInfo",
     "CommandInfo",
     "RUNFILES_PREFIX",
+    "binary_args_env_aspect",
     "rlocation_path",
     "update_attrs",
 )
@@ -21,6 +23,16 @@ _force_opt = transition(
     outputs = ["//command_line_option:compilation_mode"],
 )
 
+def _matrix_variable(name):
+    return "MULTIRUN_MATRIX_" + name.upper()
+
+def _quote_with_matrix(value, matrix):
+    """Shell quote value, with {name} expanding to its matrix variable."""
+    quoted = shell.quote(value)
+    for name in matrix:
+        quoted = quoted.replace("{%s}" % name, "'\"${%s}\"'" % _matrix_variable(name))
+    return quoted
+
 def _command_impl(ctx):
     runfiles = ctx.runfiles().merge(ctx.attr._bash_runfiles[DefaultInfo].default_runfiles)
 
@@ -39,20 +51,33 @@ def _command_impl(ctx):
 
     expansion_targets = ctx.attr.data
 
-    str_env = [
-        "export %s=%s" % (k, shell.quote(ctx.expand_location(v, targets = expansion_targets)))
-        for k, v in ctx.attr.environment.items()
-    ]
-    str_args = [
-        "%s" % shell.quote(ctx.expand_location(v, targets = expansion_targets))
-        for v in ctx.attr.arguments
+    # Like `bazel run`, the binary's own args come first and its env can be
+    # overridden. They were already expanded against the binary's data.
+    args = []
+    env = {}
+    if BinaryArgsEnvInfo in command:
+        args.extend([shell.quote(v) for v in command[BinaryArgsEnvInfo].args])
+        env.update({k: shell.quote(v) for k, v in command[BinaryArgsEnvInfo].env.items()})
+
+    # With a matrix, {name} in the arguments and environment expands to a
+    # variable the runner sets to each combination's value. Running the
+    # command by itself needs them set.
+    args.extend([_quote_with_matrix(ctx.expand_location(v, targets = expansion_targets), ctx.attr.matrix) for v in ctx.attr.arguments])
+    env.update({k: _quote_with_matrix(ctx.expand_location(v, targets = expansion_targets), ctx.attr.matrix) for k, v in ctx.attr.environment.items()})
+    matrix_checks = [
+        "[[ -n \"${%s+set}\" ]] || { echo >&2 %s; exit 2; }" % (
+            _matrix_variable(name),
+            shell.quote("set %s to one of: %s" % (_matrix_variable(name), ", ".join(values))),
+        )
+        for name, values in ctx.attr.matrix.items()
     ]
-    command_exec = " ".join(["exec $(rlocation %s)" % shell.quote(rlocation_path(ctx, executable))] + str_args + ['"$@"\n'])
+    str_env = ["export %s=%s" % (k, v) for k, v in env.items()]
+    command_exec = " ".join(['exec "$(rlocation %s)"' % shell.quote(rlocation_path(ctx, executable))] + args + ['"$@"\n'])
 
     out_file = ctx.actions.declare_file(ctx.label.name + ".bash")
     ctx.actions.write(
         output = out_file,
-        content = "\n".join([RUNFILES_PREFIX] + str_env + [command_exec]),
+        content = "\n".join([RUNFILES_PREFIX] + matrix_checks + str_env + [command_exec]),
         is_executable = True,
     )
 
@@ -64,12 +89,79 @@ def _command_impl(ctx):
         ),
     ]
 
-    if ctx.attr.description:
-        providers.append(
-            CommandInfo(
-                description = ctx.attr.description,
-            ),
-        )
+    if ctx.attr.background and ctx.attr.stdin:
+        fail("background commands can't read stdin", attr = "stdin")
+    if ctx.attr.background and ctx.attr.export_output_as:
+        fail("background commands can't export their output", attr = "export_output_as")
+    if ctx.attr.background and ctx.attr.resources:
+        fail("background commands can't use resources", attr = "resources")
+    if ctx.attr.background and ctx.attr.mutex:
+        fail("background commands can't have a mutex", attr = "mutex")
+    if ctx.attr.background and ctx.attr.group:
+        fail("background commands can't be in a group", attr = "group")
+    if ctx.attr.background and ctx.attr.deps:
+        fail("background commands can't have dependencies", attr = "deps")
+    if ctx.attr.background and ctx.attr.stage:
+        fail("background commands can't be in a stage", attr = "stage")
+    if ctx.attr.background and ctx.attr.retries:
+        fail("background commands can't be retried", attr = "retries")
+    if ctx.attr.ready_regex and not ctx.attr.background:
+        fail("only background commands can have a ready_regex", attr = "ready_regex")
+    if ctx.attr.ready_timeout_seconds <= 0:
+        fail("'ready_timeout_seconds' attribute should be greater than 0")
+    if ctx.attr.retries < 0:
+        fail("'retries' attribute should be at least 0")
+    if ctx.attr.retry_backoff < 0:
+        fail("'retry_backoff' attribute should be at least 0")
+    if ctx.attr.timeout_seconds < 0:
+        fail("'timeout_seconds' attribute should be at least 0")
+    if ctx.attr.grace_period_seconds < 0:
+        fail("'grace_period_seconds' attribute should be at least 0")
+    for name, values in ctx.attr.matrix.items():
+        if not values:
+            fail("matrix '%s' has no values" % name, attr = "matrix")
+        if not name or not name.replace("_", "a").isalnum():
+            fail("invalid matrix name '%s', expected letters, digits and underscores" % name, attr = "matrix")
+    for check in ctx.attr.wait_for:
+        if not check.startswith(("tcp:", "http://", "https://")):
+            fail("invalid wait_for check '%s', expected tcp:HOST:PORT or an http:// or https:// URL" % check, attr = "wait_for")
+    for condition in ctx.attr.run_if:
+        kind, _, value = (condition[1:] if condition.startswith("!") else condition).partition(":")
+        if kind not in ["env", "os", "arch", "file"] or not value:
+            fail("invalid run_if condition '%s', expected env:NAME, env:NAME=VALUE, os:NAME, arch:NAME, or file:PATH" % condition, attr = "run_if")
+
+    providers.append(
+        CommandInfo(
+            allow_failure = ctx.attr.allow_failure,
+            background = ctx.attr.background,
+            deps = [str(dep.label) for dep in ctx.attr.deps],
+            description = ctx.attr.description,
+            expected_duration_seconds = ctx.attr.expected_duration_seconds,
+            export_output_as = ctx.attr.export_output_as,
+            grace_period_seconds = ctx.attr.grace_period_seconds,
+            group = ctx.attr.group,
+            inputs = ctx.attr.inputs,
+            locale = ctx.attr.locale,
+            materialize_runfiles = ctx.attr.materialize_runfiles,
+            matrix = ctx.attr.matrix,
+            mutex = ctx.attr.mutex,
+            path_filters = ctx.attr.path_filters,
+            priority = ctx.attr.priority,
+            ready_regex = ctx.attr.ready_regex,
+            ready_timeout_seconds = ctx.attr.ready_timeout_seconds,
+            repository = ctx.attr.repository,
+            resources = ctx.attr.resources,
+            retries = ctx.attr.retries,
+            retry_backoff = ctx.attr.retry_backoff,
+            run_as = ctx.attr.run_as,
+            run_if = ctx.attr.run_if,
+            stage = ctx.attr.stage,
+            stdin = ctx.attr.stdin,
+            timeout_seconds = ctx.attr.timeout_seconds,
+            timezone = ctx.attr.timezone,
+            wait_for = ctx.attr.wait_for,
+        ),
+    )
 
     return providers
 
@@ -89,23 +181,116 @@ def command_with_transition(cfg, allowlist = None, doc = None):
         "arguments": attr.string_list(
             doc = "List of command line arguments. Subject to $(location) expansion. See https://docs.bazel.build/versions/master/skylark/lib/ctx.html#expand_location",
         ),
+        "allow_failure": attr.bool(
+            default = False,
+            doc = "Let this command fail without failing its multirun, for best-effort work like optional code generation. The failure doesn't stop the other commands, or the main commands when it's a `pre_commands` entry, and is still reported, as allowed, in the summary and results. Commands that depend on it are still cancelled. Failing to start the command still fails the multirun.",
+        ),
+        "background": attr.bool(
+            default = False,
+            doc = "Run this command in the background of its multirun. It starts before the other commands, doesn't affect whether the multirun succeeds, and is stopped once the other commands finish. A multirun with only background commands runs them until they exit. Useful for helpers like log tailers.",
+        ),
         "data": attr.label_list(
             doc = "The list of files needed by this command at runtime. See general comments about `data` at https://docs.bazel.build/versions/master/be/common-definitions.html#common-attributes",
             allow_files = True,
         ),
+        "deps": attr.label_list(
+            doc = "Other commands of the same list of the multirun that have to succeed before this one starts, for example a database that has to be migrated before the server starts. Commands whose dependencies fail are cancelled. Dependencies that are skipped, for example with `MULTIRUN_SKIP`, are ignored.",
+        ),
         "environment": attr.string_dict(
             doc = "Dictionary of environment variables. Subject to $(location) expansion. See https://docs.bazel.build/versions/master/skylark/lib/ctx.html#expand_location",
         ),
+        "expected_duration_seconds": attr.int(
+            default = 0,
+            doc = "How long this command is expected to take. The multirun's `over_budget` decides what happens when it takes longer than `budget_percent` of this. 0 means no budget.",
+        ),
+        "export_output_as": attr.string(
+            doc = "Export this command's stdout, with surrounding whitespace removed, as an environment variable with this name to the commands of its multirun that start after it succeeds. For example a `pre_commands` entry that starts an emulator can print the endpoint it chose for the commands that use it. The output isn't printed.",
+        ),
+        "grace_period_seconds": attr.int(
+            default = 10,
+            doc = "How many seconds this command has to exit after multirun sends it `SIGTERM`, because it timed out or the multirun is stopping, before it's killed with `SIGKILL`. On Windows commands are killed right away.",
+        ),
+        "group": attr.string(
+            doc = "The name of a concurrency group this command is in. The multirun's `group_jobs` limits how many commands of each group run at once on top of its `jobs`, for mixed workloads that a single `jobs` can't describe.",
+        ),
+        "inputs": attr.string_list(
+            doc = "Glob patterns, relative to the workspace root, of the files this command reads, for example `[\"src/*.py\", \"pyproject.toml\"]`. `*` also matches `/`. The command is skipped when none of them changed since it last succeeded with the same arguments and environment, which makes expensive formatters and linters incremental. Changes to the command's own tool aren't noticed, `MULTIRUN_CLEAN` forgets every command's inputs.",
+        ),
         "command": attr.label(
             mandatory = True,
             allow_files = True,
             executable = True,
-            doc = "Target to run",
+            doc = "Target to run. Its own `args` and `env` are passed along, before this command's `arguments` and overridden by its `environment`.",
             cfg = cfg,
+            aspects = [binary_args_env_aspect],
         ),
         "description": attr.string(
             doc = "A string describing the command printed during multiruns",
         ),
+        "locale": attr.string(
+            doc = "The locale to run this command in, set as `LANG` and `LC_ALL`, for example `C.UTF-8` so output doesn't depend on the machine. Takes precedence over the multirun's `locale` and the command's `environment`.",
+        ),
+        "materialize_runfiles": attr.bool(
+            default = False,
+            doc = "Give this command a real runfiles directory in `RUNFILES_DIR`, for tools that can't read a runfiles manifest. When runfiles only exist as a manifest, like on Windows or with `--nobuild_runfile_links`, multirun builds the directory from symlinks, or copies on Windows, for the duration of the run.",
+        ),
+        "matrix": attr.string_list_dict(
+            doc = "Run this command once for every combination of these values, for example `{\"region\": [\"us\", \"eu\"], \"env\": [\"dev\", \"prod\"]}` for 4 commands. `{name}` in `arguments` and `environment` expands to the combination's value, which multirun sets in `MULTIRUN_MATRIX_<NAME>`, so running the command by itself needs those set. Names can only have letters, digits and underscores. Each command's tag ends with its values, like `(region=us, env=dev)`. Other commands' `deps` on this command wait for all of them.",
+        ),
+        "mutex": attr.string(
+            doc = "The name of a mutex this command holds while it runs. Commands of a multirun that share a mutex never run at the same time, even when the others run in parallel, for example two commands that write to the same local database.",
+        ),
+        "path_filters": attr.string_list(
+            doc = "Glob patterns, relative to the workspace root, of the files this command is about, for example `[\"*.py\"]`. `*` also matches `/`. When its multirun only runs on changed files, see the multirun's `changed_files`, the command is skipped unless a changed file matches, and only gets the matching files.",
+        ),
+        "priority": attr.int(
+            default = 0,
+            doc = "When the multirun's `jobs` limits how many commands run at once, commands that are ready to start with a higher priority start first, otherwise commands start in the order they're given. Give long-running commands a higher priority so they don't start last and hold up the run. Can be negative.",
+        ),
+        "ready_regex": attr.string(
+            doc = "A regular expression matched against each line a background command prints. When set, the multirun's other commands only start once the command prints a matching line, e.g. `listening on`. The run fails if the command exits or `ready_timeout_seconds` passes first.",
+        ),
+        "ready_timeout_seconds": attr.int(
+            default = 60,
+            doc = "How many seconds this command has to get ready: for a background command to print a line matching its `ready_regex`, and for `wait_for` checks to pass.",
+        ),
+        "repository": attr.string(
+            doc = "The name of a sibling repository checkout, as declared in the multirun's `repositories` attribute, to run this command in",
+        ),
+        "resources": attr.string_list(
+            doc = "Names of shared external resources this command uses while it runs, for example `[\"android-emulator\"]`. Commands of a multirun wait for each other so they never use more of a resource than its capacity, see the multirun's `resource_capacities`. List a name more than once to use more of it.",
+        ),
+        "retries": attr.int(
+            default = 0,
+            doc = "How many more times to run this command when it fails before it counts as failed, for flaky commands. Its tag shows which attempt is running, and only the last attempt's output is kept when output is buffered.",
+        ),
+        "retry_backoff": attr.int(
+            default = 1,
+            doc = "How many seconds to wait before running this command again after it fails the first time, see `retries`. The wait doubles after every attempt.",
+        ),
+        "run_as": attr.string(
+            doc = "The user to run this command as, `USER[:GROUP]` with names or numeric ids like docker-compose's `user:`, for example `nobody` or `1000:1000`, when multirun runs as root in a container. The group defaults to the user's primary group. The user needs to be able to read the command's runfiles. Not supported on Windows.",
+        ),
+        "run_if": attr.string_list(
+            doc = "Conditions that all have to hold when the multirun runs for this command to run, otherwise it's skipped and reported as skipped. `env:NAME` holds when the variable is set, `env:NAME=VALUE` when it's set to the value, `os:NAME` on `linux`, `macos` or `windows`, `arch:NAME` on `x86_64` or `arm64`, and `file:PATH` when the path relative to the workspace root exists. Conditions starting with `!` hold when they otherwise wouldn't. Commands that depend on skipped commands still run.",
+        ),
+        "stage": attr.string(
+            doc = "The stage of its multirun this command runs in, one of the multirun's `stages`. It starts once every command of the stages before it succeeded, alongside the other commands of its stage.",
+        ),
+        "stdin": attr.bool(
+            default = False,
+            doc = "Connect this command to the multirun's stdin when running in parallel. At most one command in a multirun can set this, the others read from an empty stdin. Sequential commands always share stdin, one at a time.",
+        ),
+        "timeout_seconds": attr.int(
+            default = 0,
+            doc = "How many seconds this command can run before it's stopped and fails as timed out. `MULTIRUN_TIMEOUT` and `MULTIRUN_TIMEOUT_<NAME>` take precedence. 0 means no timeout.",
+        ),
+        "timezone": attr.string(
+            doc = "The timezone to run this command in, set as `TZ`, for example `UTC` so output doesn't depend on the machine. Takes precedence over the multirun's `timezone` and the command's `environment`.",
+        ),
+        "wait_for": attr.string_list(
+            doc = "Checks that must pass before this command starts, `tcp:HOST:PORT` for a port that accepts connections, or an `http://` or `https://` URL that responds with 200, for example `[\"tcp:localhost:5432\"]`. Background commands start right away and the multirun's other commands wait for the checks instead. The command fails if they don't pass within `ready_timeout_seconds`.",
+        ),
         "_bash_runfiles": attr.label(
             default = Label("@bazel_tools//tools/bash/runfiles"),
         ),
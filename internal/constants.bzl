@@ -21,10 +21,42 @@ runfiles_export_envvars
 """
 
 CommandInfo = provider(
-    fields = ["description"],
+    fields = ["allow_failure", "background", "deps", "description", "expected_duration_seconds", "export_output_as", "grace_period_seconds", "group", "inputs", "locale", "materialize_runfiles", "matrix", "mutex", "path_filters", "priority", "ready_regex", "ready_timeout_seconds", "repository", "resources", "retries", "retry_backoff", "run_as", "run_if", "stage", "stdin", "timeout_seconds", "timezone", "wait_for"],
     doc = "Information about commands used by their multirun.",
 )
 
+BinaryArgsEnvInfo = provider(
+    fields = ["args", "env"],
+    doc = "The arguments and environment to use when running the binary",
+)
+
+def _binary_args_env_aspect_impl(target, ctx):
+    if BinaryArgsEnvInfo in target:
+        return []
+
+    is_executable = target.files_to_run != None and target.files_to_run.executable != None
+    args = getattr(ctx.rule.attr, "args", [])
+    env = getattr(ctx.rule.attr, "env", {})
+
+    if is_executable and (args or env):
+        expansion_targets = getattr(ctx.rule.attr, "data", [])
+        if expansion_targets:
+            args = [
+                ctx.expand_location(arg, expansion_targets)
+                for arg in args
+            ]
+            env = {
+                name: ctx.expand_location(val, expansion_targets)
+                for name, val in env.items()
+            }
+        return [BinaryArgsEnvInfo(args = args, env = env)]
+
+    return []
+
+binary_args_env_aspect = aspect(
+    implementation = _binary_args_env_aspect_impl,
+)
+
 def update_attrs(attrs, cfg, allowlist):
     """Conditionally update attributes.
 
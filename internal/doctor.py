@@ -0,0 +1,112 @@
+"""
+Checks of the environment multirun runs in, for MULTIRUN_DOCTOR, and the
+report of what they found with hints for fixing it.
+"""
+
+import os
+import platform
+import shutil
+import sys
+import tempfile
+from typing import List, NamedTuple, TextIO
+
+from internal.output import BOLD, GREEN, RED, YELLOW, style
+
+
+class Finding(NamedTuple):
+    """One result of MULTIRUN_DOCTOR."""
+
+    check: str
+    # ok, info, warn, or fail, only failures make the doctor exit 1.
+    level: str
+    detail: str
+    hint: str = ""
+
+
+def check_python() -> Finding:
+    return Finding("python", "ok", f"{platform.python_version()} at {sys.executable}")
+
+
+def check_symlinks() -> Finding:
+    with tempfile.TemporaryDirectory() as directory:
+        try:
+            os.symlink(directory, os.path.join(directory, "link"), target_is_directory=True)
+        except (OSError, NotImplementedError) as e:
+            if platform.system() == "Windows":
+                hint = "turn on Developer Mode, without it multirun copies runfiles instead of linking them"
+            else:
+                hint = "the file system doesn't support symlinks, set MULTIRUN_CACHE_DIR to one that does"
+            return Finding("symlinks", "fail", f"can't create symlinks: {e}", hint)
+    return Finding("symlinks", "ok", "can be created")
+
+
+def check_developer_mode() -> Finding:
+    # Only exists on Windows.
+    import winreg
+
+    try:
+        with winreg.OpenKey(winreg.HKEY_LOCAL_MACHINE, r"SOFTWARE\Microsoft\Windows\CurrentVersion\AppModelUnlock") as key:
+            enabled = winreg.QueryValueEx(key, "AllowDevelopmentWithoutDevLicense")[0] == 1
+    except OSError:
+        enabled = False
+    if enabled:
+        return Finding("developer mode", "ok", "on")
+    return Finding(
+        "developer mode", "warn", "off",
+        "turn on Developer Mode in Settings so Bazel and multirun can create symlinks without admin rights",
+    )
+
+
+def check_shells() -> List[Finding]:
+    findings = []
+    if platform.system() == "Windows":
+        bash = shutil.which("bash.exe")
+        if bash:
+            findings.append(Finding("bash", "ok", bash))
+        else:
+            findings.append(Finding(
+                "bash", "fail", "bash.exe not found in PATH",
+                "install Git for Windows or MSYS2 and add the directory with bash.exe to PATH, multirun runs commands with it",
+            ))
+    else:
+        bash = shutil.which("bash")
+        if bash:
+            findings.append(Finding("bash", "ok", bash))
+        else:
+            # Commands run with their own interpreters outside of Windows.
+            findings.append(Finding("bash", "info", "bash not found in PATH", "only needed by commands that are bash scripts"))
+    pwsh = shutil.which("pwsh") or shutil.which("powershell")
+    if pwsh:
+        findings.append(Finding("powershell", "ok", pwsh))
+    else:
+        findings.append(Finding(
+            "powershell", "warn", "pwsh not found in PATH",
+            "only needed by commands that are PowerShell scripts",
+        ))
+    return findings
+
+
+def check_cache_dir(cache: str) -> Finding:
+    try:
+        os.makedirs(cache, exist_ok=True)
+        with tempfile.TemporaryFile(dir=cache):
+            pass
+    except OSError as e:
+        return Finding("cache", "fail", f"{cache} is not writable: {e}", "set MULTIRUN_CACHE_DIR to a writable directory")
+    return Finding("cache", "ok", cache)
+
+
+def report(findings: List[Finding], stream: TextIO) -> int:
+    """Print the findings with their hints, and return 1 if any of them
+    failed."""
+    styles = {"ok": (BOLD, GREEN), "info": (BOLD,), "warn": (BOLD, YELLOW), "fail": (BOLD, RED)}
+    for finding in findings:
+        level = style(finding.level.ljust(4), stream, *styles[finding.level])
+        detail = finding.detail.replace("\n", "\n" + " " * 6)
+        print(f"{level}  {finding.check}: {detail}", file=stream)
+        if finding.hint:
+            print(f"      hint: {finding.hint}", file=stream)
+    failures = sum(1 for finding in findings if finding.level == "fail")
+    print(f"{failures} problem{'' if failures == 1 else 's'} found" if failures else "No problems found", file=stream)
+    stream.flush()
+    return 1 if failures else 0
@@ -0,0 +1,47 @@
+"""
+Progress records for wrapper scripts and IDEs, a JSON object per line for
+every event of a run, see MULTIRUN_PROGRESS and MULTIRUN_EVENTS.
+"""
+
+import json
+import os
+import threading
+import time
+from typing import Any, TextIO
+
+from internal.output import warn
+
+# Formats of MULTIRUN_EVENTS.
+EVENT_FORMATS = ("jsonl",)
+
+
+class Progress:
+    """Writes progress records to a file descriptor, or a path like a named
+    pipe.
+
+    Raises:
+        OSError: The destination can't be opened.
+    """
+
+    def __init__(self, destination: str) -> None:
+        self._failed = False
+        self._lock = threading.Lock()
+        if destination.isdigit():
+            # Commands don't inherit the descriptor, Popen closes it.
+            self._stream: TextIO = os.fdopen(int(destination), "w", encoding="utf-8", closefd=False)
+        else:
+            self._stream = open(destination, "w", encoding="utf-8")
+
+    def write(self, event: str, **fields: Any) -> None:
+        record = {"event": event, "time": round(time.time(), 3)}
+        record.update(fields)
+        with self._lock:
+            if self._failed:
+                return
+            try:
+                self._stream.write(json.dumps(record, ensure_ascii=False) + "\n")
+                self._stream.flush()
+            except OSError as e:
+                # The reader going away doesn't stop the run.
+                self._failed = True
+                warn(f"failed to write progress records, not writing them anymore: {e}")
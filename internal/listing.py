@@ -0,0 +1,38 @@
+"""
+Lists the commands of a multirun without running them, see MULTIRUN_LIST.
+"""
+
+import json
+import unicodedata
+from typing import Any, Dict, List, TextIO
+
+# The values of MULTIRUN_LIST.
+LIST_FORMATS = ("table", "json")
+
+
+def print_list(entries: List[Dict[str, Any]], output_format: str, stream: TextIO) -> None:
+    """Print the commands as JSON or as a table of their tags, descriptions
+    and labels."""
+    if output_format == "json":
+        print(json.dumps(entries, indent=2, ensure_ascii=False), file=stream)
+        return
+
+    header = {"tag": "TAG", "description": "DESCRIPTION", "label": "LABEL"}
+    rows = [header] + entries
+    tag_width = max(display_width(row["tag"]) for row in rows)
+    description_width = max(display_width(row["description"]) for row in rows)
+    for row in rows:
+        print(f"{pad(row['tag'], tag_width)}  {pad(row['description'], description_width)}  {row['label']}".rstrip(), file=stream)
+
+
+def display_width(text: str) -> int:
+    """How many terminal columns text takes up, wide characters take two
+    and combining ones none."""
+    return sum(
+        0 if unicodedata.combining(char) else 2 if unicodedata.east_asian_width(char) in ("W", "F") else 1
+        for char in text
+    )
+
+
+def pad(text: str, width: int) -> str:
+    return text + " " * (width - display_width(text))
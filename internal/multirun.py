@@ -1,122 +1,4355 @@
+import argparse
+import atexit
+import hashlib
+import html
+import io
+import http.client
+import http.server
+import itertools
 import json
 import os
 import shutil
+import signal
+import socket
 import subprocess
 import sys
+import tempfile
 import platform
-from typing import Dict, List, NamedTuple, Union
+import random
+import re
+import shlex
+import functools
+import threading
+import time
+import urllib.request
+import xml.etree.ElementTree as ElementTree
+from fnmatch import fnmatchcase
+from typing import Any, Callable, Dict, List, NamedTuple, NoReturn, Optional, Set, TextIO, Tuple, Union
 
 from python.runfiles import runfiles
 
+from internal.doctor import Finding, check_cache_dir, check_developer_mode, check_python, check_shells, check_symlinks, report
+from internal.events import EVENT_FORMATS, Progress
+from internal.listing import LIST_FORMATS, print_list
+from internal.output import BOLD, GREEN, OUTPUT_FORMATS, PREFIX_COLORS, RED, YELLOW, detect_ci, end_group, print_output, print_tag, service_message_escape, start_group, style, use_color, warn, workflow_escape
+from internal.scheduler import Cancelled, Outcome, Scheduler, Status, Task
+
 _R = runfiles.Create()
 
+# Filled in when a release is created, see
+# .github/workflows/create-release.yml.
+_VERSION = "dev"
+_COMMIT = ""
+
+# Exit codes for commands that could not be started, following shell conventions.
+_EXIT_NOT_EXECUTABLE = 126
+_EXIT_NOT_FOUND = 127
+# Exit code for failures of multirun itself rather than of the commands it
+# runs, like `docker run`. Failure counts are kept below it.
+_EXIT_RUNNER_ERROR = 125
+# Exit code for runs that didn't finish before their deadline, like
+# `timeout`.
+_EXIT_DEADLINE = 124
+_MAX_FAILURE_COUNT = _EXIT_DEADLINE - 1
+
+# The instructions files of the multiruns this one is running under, so a
+# multirun that ends up running itself fails instead of forking forever.
+_STACK_ENV = "MULTIRUN_INSTRUCTIONS_STACK"
+# Set by the launcher script to find the instructions if its own runfiles
+# lookup failed.
+_INSTRUCTIONS_RLOCATION_ENV = "MULTIRUN_INSTRUCTIONS_RLOCATION"
+_LAUNCHER_ENV = "MULTIRUN_LAUNCHER"
+# Set by users to point at the instructions when none of the other locations
+# work.
+_INSTRUCTIONS_ENV = "MULTIRUN_INSTRUCTIONS"
+
+
+class RunnerError(Exception):
+    """multirun is misconfigured or its environment is broken."""
+
+
+class InstructionsError(RunnerError):
+    """The instructions file can't be read or is invalid."""
+
+
+class RunfileNotFoundError(RunnerError):
+    """A command's executable is missing from runfiles or can't be run."""
+
+    def __init__(self, tag: str, path: str, problem: str, lookups: List[str]) -> None:
+        steps = "".join(f"\n  {lookup}" for lookup in lookups)
+        super().__init__(f"'{tag}': {path} {problem}{steps}")
+        self.tag = tag
+        self.path = path
+
+
+class PreflightError(RunnerError):
+    """A command's environment won't let it start."""
+
+    def __init__(self, tag: str, problems: List[str]) -> None:
+        super().__init__(f"'{tag}': " + "; ".join(problems))
+        self.tag = tag
+        self.problems = problems
+
+
+class CycleError(RunnerError):
+    """A multirun is running itself, directly or through other multiruns."""
+
+    def __init__(self, stack: List[str]) -> None:
+        super().__init__("multirun is running itself recursively:\n  " + "\n  -> ".join(stack))
+        self.stack = stack
+
+
+class CommandsError(RunnerError):
+    """One or more commands can't be run, see errors for each of them."""
+
+    def __init__(self, errors: List[RunnerError]) -> None:
+        super().__init__("commands can't be run:\n" + "\n".join(str(e) for e in errors))
+        self.errors = errors
+
 
 class Command(NamedTuple):
     path: str
     tag: str
     args: List[str]
     env: Dict[str, str]
+    cwd: Optional[str] = None
+    # Whether the command reads the multirun's stdin when commands run in
+    # parallel.
+    stdin: bool = False
+    # Whether the command runs alongside the others until they finish
+    # without affecting the result.
+    background: bool = False
+    # The instructions list the command came from, one of _PHASES.
+    phase: str = "commands"
+    # How many seconds the command can take before it's over budget.
+    budget: Optional[float] = None
+    # How many seconds the command can run before it's killed.
+    timeout: Optional[float] = None
+    # The variable the command's stdout is exported as to the commands that
+    # start after it succeeds, if any.
+    export_output_as: Optional[str] = None
+    # Where multirun writes why it stopped the command, see _stop_reason.
+    stop_reason_file: Optional[str] = None
+    # The color code of the command's output prefix, see prefix_output.
+    color: str = ""
+    # How much of each shared resource the command uses while it runs.
+    resources: Dict[str, int] = {}
+    # The mutex the command holds while it runs, if any, see _mutex_resource.
+    mutex: Optional[str] = None
+    # The concurrency group the command is in, if any, see _group_resource.
+    group: Optional[str] = None
+    # The label of the target the command runs, if known.
+    label: str = ""
+    # The commands that have to succeed before this one starts, by name as
+    # given in the instructions until _resolve_deps replaces them with tags.
+    deps: List[str] = []
+    # The stage the command runs in, see _stage_deps.
+    stage: str = ""
+    # How many more times the command runs after failing before it counts as
+    # failed, and how many seconds to wait before the first of them. The wait
+    # doubles every time.
+    retries: int = 0
+    retry_backoff: float = 1
+    # How many seconds the command has to exit after SIGTERM before it's
+    # killed.
+    grace_period: float = 10
+    # The user id, group id, and supplementary group ids the command runs as,
+    # if not multirun's.
+    run_as: Optional[Tuple[int, int, List[int]]] = None
+    # Whether the command can fail without failing the multirun.
+    allow_failure: bool = False
+    # Ready commands with a higher priority start first when jobs limits how
+    # many run at once.
+    priority: int = 0
+    # The pattern of the line a background command prints once the others
+    # can start.
+    ready_regex: Optional[str] = None
+    # Checks that must pass before the command starts, or for background
+    # commands before the others start, see wait_for.
+    wait_for: List[str] = []
+    # How many seconds the command has to get ready.
+    ready_timeout: float = 60
+    # Globs of the workspace files the command is skipped for when they
+    # didn't change since it last succeeded, see inputs.
+    inputs: List[str] = []
+    # What the command is, other than its inputs, for recording when it
+    # last succeeded.
+    inputs_key: str = ""
+
+
+def _merge_env(*layers: Dict[str, str]) -> Dict[str, str]:
+    """Merge environments, later layers override earlier ones.
+
+    Commands see, from lowest to highest precedence: the multirun's own
+    environment, FORCE_COLOR if multirun uses colors, the multirun's runfiles
+    variables, the multirun's `environment`, the multirun's locale and
+    timezone, the command's environment, the command's locale and timezone,
+    the variables in the multirun's `env_file`, variables multirun sets for the
+    command such as MULTIRUN_REPOSITORY, and output exported by earlier
+    commands with export_output_as.
+    """
+    # Windows environment variable names are case insensitive.
+    fold = str.upper if platform.system() == "Windows" else lambda name: name
+    env: Dict[str, str] = {}
+    names: Dict[str, str] = {}
+    for layer in layers:
+        for name, value in layer.items():
+            previous = names.get(fold(name))
+            if previous is not None:
+                del env[previous]
+            names[fold(name)] = name
+            env[name] = value
+    return env
+
 
+@functools.lru_cache(maxsize=None)
+def _bash() -> str:
+    bash = shutil.which("bash.exe")
+    if not bash:
+        raise RunnerError("bash.exe not found in PATH")
+    return bash
 
-def _run_command(command: Command, block: bool, **kwargs) -> Union[int, subprocess.Popen]:
+
+def _argv(command: Command) -> List[str]:
     if platform.system() == "Windows":
-        bash = shutil.which("bash.exe")
-        if not bash:
-            raise SystemExit("error: bash.exe not found in PATH")
+        return [_bash(), "-c", f'{command.path} "$@"', "--"] + command.args
+    return [command.path] + command.args
 
-        args = [bash, "-c", f'{command.path} "$@"', "--"] + command.args
-    else:
-        args = [command.path] + command.args
-    env = dict(os.environ)
-    env.update(command.env)
-    if block:
-        return subprocess.check_call(args, env=env)
+
+# Running commands in their own session, which don't get SIGWINCH from the
+# terminal when it's resized.
+_sessions: Set[subprocess.Popen] = set()
+
+
+def _start_command(command: Command, process_group: bool, **kwargs) -> subprocess.Popen:
+    if process_group:
+        if platform.system() == "Windows":
+            kwargs["creationflags"] = subprocess.CREATE_NEW_PROCESS_GROUP
+        else:
+            kwargs["start_new_session"] = True
+    if command.stop_reason_file:
+        # Left over from an earlier run under ibazel.
+        try:
+            os.remove(command.stop_reason_file)
+        except FileNotFoundError:
+            pass
+    if command.run_as is not None:
+        kwargs["user"], kwargs["group"], kwargs["extra_groups"] = command.run_as
+    env = _merge_env(dict(os.environ), command.env)
+    if kwargs.get("stdout") == subprocess.PIPE:
+        # Commands writing to a pipe can't ask the terminal for its size.
+        env = _merge_env(_terminal_env(), env)
+    process = subprocess.Popen(_argv(command), env=env, cwd=command.cwd, **kwargs)
+    if process_group and platform.system() != "Windows":
+        _sessions.add(process)
+    if _manifest is not None:
+        _manifest.add(command, process, process_group)
+    return process
+
+
+def _terminal_env() -> Dict[str, str]:
+    if not sys.stdout.isatty():
+        return {}
+    size = shutil.get_terminal_size()
+    return {"COLUMNS": str(size.columns), "LINES": str(size.lines)}
+
+
+def _forward_resize(signum: int, frame: Any) -> None:
+    for process in list(_sessions):
+        if process.returncode is None:
+            try:
+                os.killpg(process.pid, signum)
+            except OSError:
+                pass
+
+
+def _details(command: Command) -> str:
+    """Enough about how a command is run to run it again by hand."""
+    env = _merge_env(dict(os.environ), command.env)
+    changed = sorted(
+        f"{name}={shlex.quote(value)}"
+        for name, value in env.items()
+        if os.environ.get(name) != value
+    )
+    lines = [
+        f"path: {command.path}",
+        "argv: " + " ".join(shlex.quote(arg) for arg in _argv(command)),
+        f"cwd: {command.cwd or os.getcwd()}",
+        "env: " + (" ".join(changed) or "unchanged"),
+    ]
+    return "".join(f"  {line}\n" for line in lines).rstrip("\n")
+
+
+def _color_env() -> Dict[str, str]:
+    """Tell commands to use colors when multirun does.
+
+    Commands often write to a pipe, for example when their output is
+    buffered, where they'd turn off colors on their own.
+    """
+    if not use_color(sys.stdout) or "FORCE_COLOR" in os.environ:
+        return {}
+    return {"FORCE_COLOR": "1"}
+
+
+# The CI system whose log format multirun writes, see output_format, None
+# for plain output. Set by _main.
+_ci_format: Optional[str] = None
+
+# Problems that didn't stop the run but may change what it does, like
+# runfiles that couldn't be listed, repeated in the summary.
+_problems: List[str] = []
+# Where problems are logged too, when the multirun sets system_log. Set by
+# _main.
+_system_log: Optional["_SystemLog"] = None
+
+
+def _problem(message: str) -> None:
+    """Warn about a problem that doesn't stop the run, and keep it for the
+    summary and the system log."""
+    warn(message)
+    _problems.append(message)
+    if _system_log is not None:
+        _system_log.log("warning", message)
+
+
+def _print_tag(command: Command, print_details: bool, suffix: str = "", stream: Optional[TextIO] = None) -> None:
+    print_tag(command.tag + suffix, _details(command) if print_details else None, stream or sys.stdout)
+
+
+def _start_group(command: Command, print_details: bool, suffix: str = "", stream: Optional[TextIO] = None) -> None:
+    """Print the tag before a command's output, in CI logs as the title of
+    a section the output can be collapsed into until _end_group."""
+    start_group(command.tag + suffix, _details(command) if print_details else None, _ci_format, stream or sys.stdout)
+
+
+def _end_group(command: Command, suffix: str, failed: bool, stream: Optional[TextIO] = None) -> None:
+    end_group(command.tag + suffix, failed, _ci_format, stream or sys.stdout)
+
+
+def _write_reason(path: Optional[str], reason: str) -> None:
+    if path:
+        with open(path, "w", encoding="utf-8") as f:
+            f.write(reason + "\n")
+
+
+def _stop_reason(command: Command, reason: str) -> None:
+    """Tell a command why it's being stopped, before stopping it.
+
+    Reasons are a kind, one of failure, timeout, interrupt, restart,
+    finished, or down, then a colon and a description for people.
+    """
+    try:
+        _write_reason(command.stop_reason_file, reason)
+    except OSError as e:
+        warn(f"failed to tell '{command.tag}' why it's stopped: {e}")
+
+
+def _terminate(process: subprocess.Popen, process_group: bool) -> None:
+    """Ask a command to exit with SIGTERM, along with its process group if
+    it has one. Windows has no equivalent, so commands are killed there."""
+    if platform.system() == "Windows":
+        _kill(process, process_group)
+        return
+    try:
+        if process_group:
+            os.killpg(process.pid, signal.SIGTERM)
+        else:
+            process.terminate()
+    except ProcessLookupError:
+        pass
+    except PermissionError:
+        process.terminate()
+
+
+def _kill(process: subprocess.Popen, process_group: bool) -> None:
+    if not process_group:
+        process.kill()
+    elif platform.system() == "Windows":
+        taskkill = subprocess.run(["taskkill", "/F", "/T", "/PID", str(process.pid)], stdout=subprocess.PIPE, stderr=subprocess.STDOUT)
+        if taskkill.returncode != 0 and process.poll() is None:
+            warn(f"failed to kill the process tree of {process.pid}, only killing the process itself: {taskkill.stdout.decode(errors='replace').strip()}")
+            process.kill()
     else:
-        return subprocess.Popen(args, env=env, **kwargs)
+        try:
+            os.killpg(process.pid, signal.SIGKILL)
+        except ProcessLookupError:
+            pass
+        except PermissionError as e:
+            warn(f"failed to kill the process group of {process.pid}, only killing the process itself: {e}")
+            process.kill()
+
+
+class _PathNormalizer:
+    """Rewrites absolute paths in command output to workspace relative ones
+    with forward slashes, so logs from different machines and platforms can
+    be compared."""
+
+    def __init__(self, workspace_name: str, runfiles_dir: Optional[str], workspace: Optional[str]) -> None:
+        prefixes: List[Tuple[str, str]] = []
+        if runfiles_dir:
+            prefixes += [(os.path.join(runfiles_dir, workspace_name), ""), (runfiles_dir, "external/")]
+            # Runfiles are usually under <output_base>/execroot/<workspace>.
+            parts = re.split(r"[\\/]", runfiles_dir)
+            if "execroot" in parts:
+                index = parts.index("execroot")
+                prefixes += [("/".join(parts[: index + 2]), ""), ("/".join(parts[:index]), "")]
+        if workspace:
+            prefixes.append((workspace, ""))
+
+        self._replacements: Dict[str, str] = {}
+        for prefix, replacement in prefixes:
+            for path in (prefix, os.path.realpath(prefix)):
+                if self._canonical(path):
+                    self._replacements.setdefault(self._canonical(path), replacement)
+        # Longer prefixes are more specific so they're tried first.
+        alternatives = [
+            r"[\\/]".join(re.escape(part) for part in path.split("/"))
+            for path in sorted(self._replacements, key=len, reverse=True)
+        ]
+        self._pattern: Optional["re.Pattern[str]"] = None
+        if alternatives:
+            flags = re.IGNORECASE if platform.system() == "Windows" else 0
+            self._pattern = re.compile(f"({'|'.join(alternatives)})[\\\\/]([^\\s'\"]*)", flags)
+
+    @staticmethod
+    def _canonical(path: str) -> str:
+        path = path.replace("\\", "/").rstrip("/")
+        return path.lower() if platform.system() == "Windows" else path
+
+    def _replace(self, match: "re.Match[str]") -> str:
+        return self._replacements[self._canonical(match.group(1))] + match.group(2).replace("\\", "/")
+
+    def normalize(self, text: str) -> str:
+        if self._pattern is None:
+            return text
+        return self._pattern.sub(self._replace, text)
+
+
+class _SystemLog:
+    """Logs run events to syslog on Unix and the Event Log on Windows."""
+
+    def __init__(self, name: str) -> None:
+        self._name = name
+        self._windows = platform.system() == "Windows"
+        self._failed = False
+        if not self._windows:
+            # Only exists on Unix.
+            import syslog
+            syslog.openlog("multirun", syslog.LOG_PID, syslog.LOG_USER)
+            self._syslog = syslog
+
+    def log(self, level: str, message: str) -> None:
+        """Log a message with level info, warning or error."""
+        message = f"{self._name}: {message}"
+        if not self._windows:
+            priority = {"info": self._syslog.LOG_INFO, "warning": self._syslog.LOG_WARNING, "error": self._syslog.LOG_ERR}[level]
+            self._syslog.syslog(priority, message)
+            return
+
+        if self._failed:
+            return
+        event_type = {"info": "INFORMATION", "warning": "WARNING", "error": "ERROR"}[level]
+        try:
+            result = subprocess.run(
+                ["eventcreate", "/L", "APPLICATION", "/SO", "multirun", "/T", event_type, "/ID", "1", "/D", message],
+                stdin=subprocess.DEVNULL,
+                stdout=subprocess.PIPE,
+                stderr=subprocess.STDOUT,
+            )
+            error = result.stdout.decode(errors="replace").strip() if result.returncode != 0 else None
+        except OSError as e:
+            error = str(e)
+        if error is not None:
+            # Creating the event source needs admin rights the first time.
+            self._failed = True
+            warn(f"failed to write to the Event Log, not logging there anymore: {error}")
+
+
+def _progress(destination: str) -> Progress:
+    """Open a file descriptor, or a path relative to the workspace root, for
+    progress records."""
+    name = f"file descriptor {destination}" if destination.isdigit() else destination
+    try:
+        return Progress(destination if destination.isdigit() else os.path.join(_workspace_dir(), destination))
+    except OSError as e:
+        raise InstructionsError(f"failed to open {name} for progress records: {e}") from e
+
+
+class _Health:
+    """Serves /healthz and /readyz for load balancers and container probes.
+
+    A run is healthy while none of its background commands exited, and ready
+    while it's healthy, once its pre commands succeeded and until its post
+    commands start.
+    """
+
+    def __init__(self, port: int) -> None:
+        self._lock = threading.Lock()
+        self._background: List[Tuple[Command, subprocess.Popen]] = []
+        self._pending: Set[str] = set()
+        self._stopping = True
+        health = self
+
+        class Handler(http.server.BaseHTTPRequestHandler):
+            def do_GET(self) -> None:
+                health._respond(self)
+
+            def log_message(self, *args: Any) -> None:
+                # Probes would drown out the commands' output.
+                pass
+
+        try:
+            # On every interface, probes come from outside containers.
+            self._server = http.server.ThreadingHTTPServer(("", port), Handler)
+        except OSError as e:
+            raise InstructionsError(f"failed to serve health checks on port {port}: {e}") from e
+        self._server.daemon_threads = True
+        threading.Thread(target=self._server.serve_forever, daemon=True).start()
+
+    def run_started(self, commands: List[Command], background: List[Tuple[Command, subprocess.Popen]]) -> None:
+        with self._lock:
+            self._background = background
+            self._pending = {command.tag for command in commands if command.phase == "pre_commands"}
+            self._stopping = False
+
+    def started(self, command: Command) -> None:
+        if command.phase == "post_commands":
+            with self._lock:
+                self._stopping = True
+
+    def finished(self, command: Command, succeeded: bool) -> None:
+        if succeeded:
+            with self._lock:
+                self._pending.discard(command.tag)
+
+    def run_finished(self) -> None:
+        with self._lock:
+            self._background = []
+            self._stopping = True
+
+    def _state(self) -> Dict[str, Any]:
+        with self._lock:
+            background = {command.tag: process.poll() for command, process in self._background}
+            healthy = all(returncode is None for returncode in background.values())
+            return {
+                "healthy": healthy,
+                "ready": healthy and not self._stopping and not self._pending,
+                "background": {tag: "running" if returncode is None else f"exited with code {returncode}" for tag, returncode in background.items()},
+                "pending_pre_commands": sorted(self._pending),
+            }
+
+    def _respond(self, handler: http.server.BaseHTTPRequestHandler) -> None:
+        path = handler.path.partition("?")[0]
+        if path not in ("/healthz", "/readyz"):
+            handler.send_error(404)
+            return
+        state = self._state()
+        body = (json.dumps(state) + "\n").encode()
+        handler.send_response(200 if state["healthy" if path == "/healthz" else "ready"] else 503)
+        handler.send_header("Content-Type", "application/json")
+        handler.send_header("Content-Length", str(len(body)))
+        handler.end_headers()
+        handler.wfile.write(body)
+
+
+class _OutputSlicer:
+    """Prints the complete lines buffered commands wrote since the last slice
+    every few seconds, so long running commands show progress without their
+    output interleaving line by line.
+
+    Commands write to files while they're watched, the rest of their output
+    is printed when they finish.
+    """
+
+    def __init__(self, seconds: float, print_command: bool, print_details: bool, normalizer: Optional[_PathNormalizer], stdout: Optional[TextIO]) -> None:
+        self.directory = os.path.join(_run_dir(), "output")
+        os.makedirs(self.directory, exist_ok=True)
+        # Held while printing slices, and the rest of the output.
+        self.lock = threading.Lock()
+        self._print_command = print_command
+        self._print_details = print_details
+        self._normalize = None if normalizer is None else normalizer.normalize
+        self._stdout = stdout
+        # The command, path, and tag suffix of each watched key.
+        self._watched: Dict[str, Tuple[Command, str, str]] = {}
+        # How much of each key's output was printed.
+        self._released: Dict[str, int] = {}
+        threading.Thread(target=self._run, args=(seconds,), daemon=True).start()
+
+    def watch(self, key: str, command: Command, path: str, suffix: str) -> None:
+        with self.lock:
+            self._watched[key] = (command, path, suffix)
+            self._released[key] = 0
+
+    def unwatch(self, key: str) -> bytes:
+        """Stop slicing the key's output, and return all of it."""
+        with self.lock:
+            _, path, _ = self._watched.pop(key)
+            with open(path, "rb") as f:
+                return f.read()
+
+    def released(self, key: str) -> int:
+        with self.lock:
+            return self._released.get(key, 0)
+
+    def print(self, command: Command, output: bytes, suffix: str, continued: bool, failed: bool = False) -> None:
+        """Print output with its tag, the caller holds the lock."""
+        suffix += " (continued)" if continued else ""
+        if self._print_command:
+            _start_group(command, self._print_details and not continued, suffix, stream=self._stdout)
+        if output:
+            print_output(output.strip(), self._stdout or sys.stdout, normalize=self._normalize)
+        if self._print_command:
+            _end_group(command, suffix, failed, self._stdout)
+
+    def _run(self, seconds: float) -> None:
+        while True:
+            time.sleep(seconds)
+            with self.lock:
+                for key, (command, path, suffix) in self._watched.items():
+                    released = self._released[key]
+                    try:
+                        with open(path, "rb") as f:
+                            f.seek(released)
+                            output = f.read()
+                    except OSError:
+                        continue
+                    # Only whole lines, which also keeps characters whole.
+                    end = output.rfind(b"\n") + 1
+                    if end == 0 or not output[:end].strip():
+                        continue
+                    self.print(command, output[:end], suffix, released > 0)
+                    self._released[key] = released + end
+
+
+class _Stagger:
+    """Spaces out when parallel commands start, see stagger_ms."""
+
+    def __init__(self, seconds: float) -> None:
+        self._seconds = seconds
+        self._lock = threading.Lock()
+        # When the next command can start, as a time.monotonic() time.
+        self._next = 0.0
+
+    def wait(self, cancelled: threading.Event) -> bool:
+        """Wait for a command's turn to start, and return whether the run
+        was cancelled first."""
+        with self._lock:
+            now = time.monotonic()
+            start = max(now, self._next)
+            self._next = start + self._seconds
+        return cancelled.wait(start - now)
+
+
+_TIMESTAMPS = ("none", "clock", "elapsed")
+
+
+class _Timestamps:
+    """Stamps forwarded lines with the time of day, or the time since
+    multirun started, see timestamps."""
+
+    def __init__(self, kind: str) -> None:
+        self._kind = kind
+        self._started = time.monotonic()
+
+    def now(self) -> str:
+        if self._kind == "elapsed":
+            return f"+{time.monotonic() - self._started:.3f}s"
+        now = time.time()
+        return f"{time.strftime('%H:%M:%S', time.localtime(now))}.{int(now % 1 * 1000):03d}"
+
+
+class _LinePrefixer:
+    """Prints the lines a command writes as soon as they're complete, after
+    its tag or a timestamp, so the output of concurrent commands can be told
+    apart while they run.
+
+    The command writes to a pipe, which is read until the command and any
+    processes it started closed it.
+    """
+
+    # Held while printing a line, so lines of different commands don't mix.
+    _lock = threading.Lock()
+
+    def __init__(self, command: Command, stream: TextIO, tag: bool, timestamps: Optional[_Timestamps], log: Optional[str] = None, events: Optional[Progress] = None) -> None:
+        read, self.fd = os.pipe()
+        self._command = command
+        self._events = events
+        codes = (BOLD, command.color) if command.color else (BOLD,)
+        prefix = f"{style(f'[{command.tag}]', stream, *codes)} " if tag else ""
+        self._log = None
+        if log is not None:
+            try:
+                self._log = open(log, "ab")
+            except OSError as e:
+                warn(f"failed to write the log of '{command.tag}' to {log}: {e}")
+        self._thread = threading.Thread(target=self._run, args=(read, prefix, timestamps, stream), daemon=True)
+        self._thread.start()
+
+    def _run(self, fd: int, prefix: str, timestamps: Optional[_Timestamps], stream: TextIO) -> None:
+        with open(fd, "rb") as f:
+            for line in f:
+                if self._log is not None:
+                    # Logs get the output as it was written.
+                    self._log.write(line)
+                    self._log.flush()
+                # Stamped when the line was read, which is when it was written
+                # for commands that don't buffer their output.
+                stamp = "" if timestamps is None else f"{timestamps.now()} "
+                line = line.rstrip(b"\r\n")
+                if self._events is not None:
+                    # Records have their own time.
+                    self._events.write("output", tag=self._command.tag, phase=self._command.phase, line=line.decode(errors="replace"))
+                    continue
+                with self._lock:
+                    print_output(line, stream, f"{stamp}{prefix}")
+
+    def close(self) -> None:
+        """Close multirun's end of the pipe once the command finished, and
+        wait for the rest of its output."""
+        os.close(self.fd)
+        # Processes the command left running can keep the pipe open.
+        self._thread.join(timeout=1)
+        if self._log is not None and not self._thread.is_alive():
+            self._log.close()
+
+
+class _Pipeline:
+    """The pipes between the commands of a pipeline, closed in multirun once
+    the commands at both ends have started with their own copies."""
+
+    def __init__(self, count: int) -> None:
+        pipes = [os.pipe() for _ in range(count - 1)]
+        self.stdin: List[Optional[int]] = [None] + [read for read, _ in pipes]
+        self.stdout: List[Optional[int]] = [write for _, write in pipes] + [None]
+        self._lock = threading.Lock()
+        self._open = {fd for pipe in pipes for fd in pipe}
+
+    def close(self, index: int) -> None:
+        """Close multirun's ends of a command's pipes once it's done with
+        them, so the next command sees the end of its input, and the previous
+        one that nothing reads its output anymore."""
+        with self._lock:
+            for fd in (self.stdin[index], self.stdout[index]):
+                if fd in self._open:
+                    self._open.discard(fd)
+                    os.close(fd)
+
+    def close_all(self) -> None:
+        for index in range(len(self.stdin)):
+            self.close(index)
+
 
+class _Options(NamedTuple):
+    """How to run commands, the same code path handles every mode."""
+    # The maximum number of commands running at once.
+    jobs: int
+    # Whether commands run alongside each other. This follows the configured
+    # jobs rather than the effective concurrency, so a parallel multirun
+    # doesn't change behavior when it only has one command.
+    parallel: bool
+    print_command: bool
+    # Whether the path, argv, cwd, and environment are printed with tags.
+    print_details: bool
+    keep_going: bool
+    buffer_output: bool
+    # What to do about commands that take longer than their budget, one of
+    # ignore, warn, or fail.
+    over_budget: str = "warn"
+    # Whether commands can interact with the user, which they can't in build
+    # actions.
+    interactive: bool = True
+    # Whether ibazel restarts the commands, which have to stop along with the
+    # processes they started so that none are left behind.
+    restartable: bool = False
+    # Where failed commands are logged besides the summary, if anywhere.
+    system_log: Optional[_SystemLog] = None
+    # Rewrites paths in buffered output, if set.
+    normalizer: Optional[_PathNormalizer] = None
+    # The output commands exported with export_output_as so far, by variable
+    # name, shared by every phase of a run.
+    exports: Optional[Dict[str, str]] = None
+    # Where tags and buffered output are printed, sys.stdout if unset.
+    # Unbuffered output goes straight from commands to multirun's stdout.
+    stdout: Optional[TextIO] = None
+    # How many commands can use each shared resource at once.
+    resource_capacities: Optional[Dict[str, int]] = None
+    # Where command progress is written, if anywhere.
+    progress: Optional[Progress] = None
+    # Whether commands that run out of memory lower jobs and run again.
+    adaptive_jobs: bool = False
+    # Serves the state of the run to health checks, if set.
+    health: Optional[_Health] = None
+    # Prints buffered output in slices while commands run, if set.
+    slicer: Optional[_OutputSlicer] = None
+    # Spaces out when commands start, if set.
+    stagger: Optional[_Stagger] = None
+    # Whether each command's stdout is connected to the next one's stdin,
+    # see pipeline.
+    pipeline: bool = False
+    # Whether each line of output is printed as soon as it's complete, after
+    # the command's tag, see prefix_output.
+    prefix_output: bool = False
+    # Stamps each line of output as soon as it's complete, if set.
+    timestamps: Optional[_Timestamps] = None
+    # Where each command's output is written besides the terminal, if
+    # anywhere, see log_dir.
+    log_dir: Optional[str] = None
+    # Whether each line of output is written as a progress record instead of
+    # being printed, see MULTIRUN_EVENTS.
+    events: bool = False
 
-def _perform_concurrently(commands: List[Command], print_command: bool, buffer_output: bool) -> bool:
+
+def _options(
+    jobs: int,
+    command_count: int,
+    print_command: bool,
+    print_details: bool,
+    keep_going: bool,
+    buffer_output: bool,
+    over_budget: str = "warn",
+    interactive: bool = True,
+    system_log: Optional[_SystemLog] = None,
+    normalizer: Optional[_PathNormalizer] = None,
+    stop_on_error: bool = False,
+) -> _Options:
+    parallel = jobs != 1
+    # Unbuffered output from concurrent commands is interleaved, so tags are
+    # only printed along with buffered output.
+    print_command = print_command and (buffer_output or not parallel)
+    return _Options(
+        jobs=max(min(jobs or command_count, command_count), 1),
+        parallel=parallel,
+        print_command=print_command,
+        print_details=print_details and print_command,
+        # Parallel commands are started together, so they all run to
+        # completion unless the first failure should stop them.
+        keep_going=keep_going or (parallel and not stop_on_error),
+        buffer_output=buffer_output and parallel,
+        over_budget=over_budget,
+        interactive=interactive,
+        system_log=system_log,
+        normalizer=normalizer,
+    )
+
+
+class _Process(NamedTuple):
+    returncode: int
+    output: Optional[bytes]
+    duration: float
+    # Whether the process was killed for running past its deadline.
+    timed_out: bool = False
+    # How many times the command ran, the process is the last of them.
+    attempts: int = 1
+    # When the command first started, as a time.time() timestamp.
+    started: float = 0
+
+
+class LaunchError(Exception):
+    """A command could not be started, the cause is the underlying OSError."""
+
+    def __init__(self, command: Command, cause: OSError) -> None:
+        super().__init__(f"failed to launch: {cause}")
+        self.command = command
+        self.__cause__ = cause
+
+    @property
+    def exit_code(self) -> int:
+        return _EXIT_NOT_FOUND if isinstance(self.__cause__, FileNotFoundError) else _EXIT_NOT_EXECUTABLE
+
+
+class NotReadyError(Exception):
+    """A command's wait_for checks didn't pass within its ready timeout."""
+
+    exit_code = 1
+
+    def __init__(self, command: Command, check: str) -> None:
+        super().__init__(f"wait_for '{check}' didn't pass within {command.ready_timeout:g}s")
+        self.command = command
+
+
+class CommandResult(NamedTuple):
+    command: Command
+    status: Status
+    # The command's exit code, with death by signal N reported as 128 + N like
+    # shells do. None if the command never ran.
+    exit_code: Optional[int] = None
+    output: Optional[bytes] = None
+    duration: float = 0
+    # Why the command could not be started.
+    error: Optional[Union[LaunchError, NotReadyError]] = None
+    # The signal that killed the command, if any.
+    signal: Optional[int] = None
+    timed_out: bool = False
+    # Whether the command failed only because it took longer than its budget.
+    over_budget: bool = False
+    # How many times the command ran.
+    attempts: int = 1
+    # When the command started, as a time.time() timestamp, 0 if it never
+    # ran.
+    started: float = 0
+    # Why the command was skipped without running, see run_if.
+    skipped: Optional[str] = None
+
+
+def _command_task(command: Command, key: str, options: _Options, cancel_reason: Callable[[], str], pipeline: Optional[_Pipeline] = None) -> Task:
     kwargs = {}
-    if buffer_output:
+    if options.buffer_output:
         kwargs = {
              "stdout" : subprocess.PIPE,
              "stderr" : subprocess.STDOUT
         }
+    # Concurrent commands reading the terminal would steal each other's input.
+    if (options.parallel and not command.stdin) or not options.interactive:
+        kwargs["stdin"] = subprocess.DEVNULL
+    # Commands that run alongside others get their own process group so that
+    # cancelling them also stops any processes they started. Commands that run
+    # alone stay in the foreground so they can interact with the terminal,
+    # unless ibazel owns it.
+    process_group = options.parallel or options.restartable
+    if command.export_output_as:
+        # Only stdout is exported, errors still reach the terminal.
+        kwargs["stdout"] = subprocess.PIPE
+        kwargs.pop("stderr", None)
+    # Exported output isn't printed, so there's nothing to slice.
+    slicer = options.slicer if options.buffer_output and not command.export_output_as else None
+    log_path = None if options.log_dir is None else os.path.join(options.log_dir, _log_name(command))
+    index = int(key)
+    if pipeline is not None:
+        # Like in a shell pipeline the first command reads multirun's stdin
+        # and the last one writes to its stdout, errors reach the terminal.
+        if pipeline.stdin[index] is not None:
+            kwargs["stdin"] = pipeline.stdin[index]
+        elif options.interactive:
+            kwargs.pop("stdin", None)
+        if pipeline.stdout[index] is not None:
+            kwargs["stdout"] = pipeline.stdout[index]
 
-    processes = [
-        (command, _run_command(command, block=False, **kwargs))
-        for command
-        in commands
-    ]
+    def run(cancelled: threading.Event) -> _Process:
+        if options.stagger is not None and options.stagger.wait(cancelled):
+            raise Cancelled()
+        if command.wait_for:
+            _wait_for(command, cancelled)
+        duration = 0.0
+        started = 0.0
+        for attempt in range(1, command.retries + 2):
+            if attempt > 1:
+                delay = command.retry_backoff * 2 ** (attempt - 2)
+                warn(f"'{command.tag}' {_describe(_command_result(command, Outcome(Status.FAILED, process)))}, running it again in {delay:g}s")
+                if cancelled.wait(delay):
+                    raise Cancelled(process._replace(duration=duration, attempts=attempt - 1, started=started))
+                if options.print_command and not options.buffer_output:
+                    _end_group(command, _attempt_suffix(command, attempt - 1), True, options.stdout)
+                    _start_group(command, options.print_details, _attempt_suffix(command, attempt), stream=options.stdout)
+            deadline = None if command.timeout is None else time.monotonic() + command.timeout
+            to_run = command
+            if options.exports:
+                to_run = command._replace(env=_merge_env(command.env, dict(options.exports)))
+            # Buffered output is logged once the command finished.
+            if options.prefix_output or options.timestamps is not None or options.events or (log_path is not None and not options.buffer_output):
+                prefixer = _LinePrefixer(command, options.stdout or sys.stdout, options.prefix_output, options.timestamps, log_path, options.progress if options.events else None)
+                # Exported output isn't printed, only its errors are.
+                streams = {"stderr": prefixer.fd} if command.export_output_as else {"stdout": prefixer.fd, "stderr": subprocess.STDOUT}
+                try:
+                    process = _run_command(to_run, cancelled, deadline, process_group, cancel_reason, **dict(kwargs, **streams))
+                finally:
+                    prefixer.close()
+            elif slicer is None:
+                process = _run_command(to_run, cancelled, deadline, process_group, cancel_reason, **kwargs)
+            else:
+                path = os.path.join(slicer.directory, f"{key}.log")
+                with open(path, "wb") as log:
+                    slicer.watch(key, command, path, _attempt_suffix(command, attempt))
+                    try:
+                        process = _run_command(to_run, cancelled, deadline, process_group, cancel_reason, **dict(kwargs, stdout=log))
+                    finally:
+                        output = slicer.unwatch(key)
+                process = process._replace(output=output)
+            duration += process.duration
+            started = started or process.started
+            if process.returncode == 0:
+                break
+        process = process._replace(duration=duration, attempts=attempt, started=started)
+        if command.export_output_as and options.exports is not None:
+            if process.returncode == 0:
+                options.exports[command.export_output_as] = (process.output or b"").decode(errors="replace").strip()
+            # Exported output isn't printed.
+            process = process._replace(output=None)
+        return process
+
+    if pipeline is not None:
+        unpiped = run
+
+        def run(cancelled: threading.Event) -> _Process:
+            try:
+                return unpiped(cancelled)
+            finally:
+                pipeline.close(index)
+
+    if log_path is not None:
+        unlogged = run
+
+        def run(cancelled: threading.Event) -> _Process:
+            # Every run starts a new log, attempts add to it.
+            _write_log(command, log_path, b"", "wb")
+            try:
+                process = unlogged(cancelled)
+            except Cancelled as e:
+                if isinstance(e.value, _Process) and e.value.output:
+                    _write_log(command, log_path, e.value.output)
+                raise
+            if process.output:
+                _write_log(command, log_path, process.output)
+            return process
+
+    resources = dict(command.resources)
+    if command.mutex is not None:
+        resources[_mutex_resource(command.mutex)] = 1
+    if command.group is not None:
+        resources[_group_resource(command.group)] = 1
+    return Task(key, run, priority=command.priority, resources=resources)
+
+
+def _log_name(command: Command) -> str:
+    """The name of the command's file in log_dir, its tag without the
+    characters that aren't safe in file names, and a short hash of the tag
+    so tags that only differ in those characters, or in case, get logs of
+    their own."""
+    stem = re.sub(r"[^A-Za-z0-9._-]+", "_", command.tag).strip("_.") or "command"
+    return f"{stem}-{hashlib.sha256(command.tag.encode()).hexdigest()[:8]}.log"
 
-    success = True
+
+def _write_log(command: Command, path: str, output: bytes, mode: str = "ab") -> None:
+    """Logs are only a copy of the output, failing to write them doesn't
+    change the outcome of the run."""
     try:
-        for command, process in processes:
-            process.wait()
-            if print_command and buffer_output:
-                print(command.tag, flush=True)
+        with open(path, mode) as f:
+            f.write(output)
+    except OSError as e:
+        warn(f"failed to write the log of '{command.tag}' to {path}: {e}")
 
-            stdout = process.communicate()[0]
-            if stdout:
-                print(stdout.decode().strip(), flush=True)
 
-            if process.returncode != 0:
-                success = False
-    except KeyboardInterrupt:
-        for command, process in processes:
-            process.kill()
-            process.wait()
-        success = False
+def _log_dir(path: str) -> str:
+    """Where log_dir is, relative paths are in the test's undeclared
+    outputs, or the directory bazel run was run in."""
+    if not os.path.isabs(path):
+        path = os.path.join(os.environ.get("TEST_UNDECLARED_OUTPUTS_DIR") or os.environ.get("BUILD_WORKING_DIRECTORY") or os.getcwd(), path)
+    try:
+        os.makedirs(path, exist_ok=True)
+    except OSError as e:
+        raise InstructionsError(f"failed to create log_dir {path}: {e}") from e
+    return path
 
-    return success
 
+def _attempt_suffix(command: Command, attempt: int) -> str:
+    """Shown after the tags of commands that can run more than once."""
+    if not command.retries:
+        return ""
+    return f" (attempt {attempt} of {command.retries + 1})"
 
-def _perform_serially(commands: List[Command], print_command: bool, keep_going: bool) -> bool:
-    success = True
-    for command in commands:
-        if print_command:
-            print(command.tag, flush=True)
 
+def _run_command(
+    command: Command,
+    cancelled: threading.Event,
+    deadline: Optional[float],
+    process_group: bool,
+    cancel_reason: Callable[[], str],
+    **kwargs: Any,
+) -> _Process:
+    """Run a command to completion, cancellation, or its deadline.
+
+    This is where commands are stopped early: they're sent SIGTERM, with
+    their process group if they have one, as soon as cancelled is set or the
+    time.monotonic() deadline passes, and killed if they're still running
+    after their grace period. They're told why first, with cancel_reason for
+    cancellations.
+
+    Raises:
+        LaunchError: The command could not be started.
+        Cancelled: The run was cancelled, its value is the killed _Process.
+    """
+    start = time.monotonic()
+    started = time.time()
+    try:
+        process = _start_command(command, process_group, **kwargs)
+    except OSError as e:
+        raise LaunchError(command, e) from e
+
+    timed_out = False
+    was_cancelled = False
+    # When the command was sent SIGTERM, and whether it was killed since.
+    stopping: Optional[float] = None
+    killed = False
+    try:
+        while True:
+            try:
+                output = process.communicate(timeout=0.1)[0]
+                break
+            except subprocess.TimeoutExpired:
+                if stopping is None and cancelled.is_set():
+                    _stop_reason(command, cancel_reason())
+                    was_cancelled = True
+                elif stopping is None and deadline is not None and time.monotonic() >= deadline:
+                    _stop_reason(command, f"timeout: ran longer than {command.timeout:g}s")
+                    timed_out = True
+                if stopping is None and (was_cancelled or timed_out):
+                    stopping = time.monotonic()
+                    _terminate(process, process_group)
+                elif stopping is not None and not killed and time.monotonic() - stopping >= command.grace_period:
+                    _kill(process, process_group)
+                    killed = True
+        if stopping is not None and process_group and not killed:
+            # Don't leave behind processes that outlived the command.
+            _kill(process, process_group)
+    finally:
+        _sessions.discard(process)
+        if _manifest is not None:
+            _manifest.remove(process)
+
+    if was_cancelled:
+        raise Cancelled(_Process(process.returncode, output, time.monotonic() - start, started=started))
+    return _Process(process.returncode, output, time.monotonic() - start, timed_out, started=started)
+
+
+# Output of commands that failed to allocate memory.
+_EXHAUSTED_OUTPUT = re.compile(rb"ENOMEM|Cannot allocate memory")
+
+
+def _exhausted(value: Any) -> bool:
+    """Whether a failed command looks like it ran out of memory: it was
+    killed with SIGKILL, which is what the OOM killer sends, or its buffered
+    output says so."""
+    if not isinstance(value, _Process) or value.timed_out:
+        return False
+    # SIGKILL is 9 wherever it exists, shells report children killed by it
+    # as exit code 137.
+    if value.returncode in (-9, 128 + 9):
+        return True
+    return value.output is not None and _EXHAUSTED_OUTPUT.search(value.output) is not None
+
+
+def _command_result(command: Command, outcome: Outcome) -> CommandResult:
+    if isinstance(outcome.value, _Process):
+        process = outcome.value
+        # Popen reports death by signal N as -N.
+        if process.returncode < 0:
+            return CommandResult(command, outcome.status, 128 - process.returncode, process.output, process.duration, signal=-process.returncode, timed_out=process.timed_out, attempts=process.attempts, started=process.started)
+        return CommandResult(command, outcome.status, process.returncode, process.output, process.duration, timed_out=process.timed_out, attempts=process.attempts, started=process.started)
+    if outcome.value is None:
+        return CommandResult(command, outcome.status)
+    if isinstance(outcome.value, (LaunchError, NotReadyError)):
+        return CommandResult(command, outcome.status, error=outcome.value)
+    # Anything else is a bug in multirun, let it surface with a traceback.
+    raise outcome.value
+
+
+def _check_budget(result: CommandResult, over_budget: str) -> CommandResult:
+    budget = result.command.budget
+    if over_budget == "ignore" or budget is None or result.exit_code is None or result.duration <= budget:
+        return result
+    if over_budget == "fail" and result.status == Status.SUCCEEDED:
+        return result._replace(status=Status.FAILED, over_budget=True)
+    warn(f"'{result.command.tag}' took {result.duration:.1f}s, over its budget of {budget:.1f}s")
+    return result
+
+
+class _Reporter:
+    """Collects a result for every command and prints tags and buffered
+    output in the order commands were given."""
+
+    def __init__(self, commands: List[Command], options: _Options, on_result: Callable[[CommandResult], None]) -> None:
+        self._commands = commands
+        self._print_command = options.print_command
+        self._print_details = options.print_details
+        self._over_budget = options.over_budget
+        self._buffer_output = options.buffer_output
+        self._system_log = options.system_log
+        self._normalizer = options.normalizer
+        self._progress = options.progress
+        self._health = options.health
+        self._slicer = options.slicer if options.buffer_output else None
+        self._stdout = options.stdout or sys.stdout
+        self._on_result = on_result
+        self._pending: Dict[int, CommandResult] = {}
+        self._next = 0
+        # Commands whose output is in a group until they finish.
+        self._grouped: Set[int] = set()
+        # Results in the order commands finished.
+        self.results: List[CommandResult] = []
+
+    def started(self, task: Task) -> None:
+        command = self._commands[int(task.key)]
+        if self._progress is not None:
+            self._progress.write("started", tag=command.tag, phase=command.phase)
+        if self._health is not None:
+            self._health.started(command)
+        if self._print_command and not self._buffer_output:
+            self._grouped.add(int(task.key))
+            _start_group(command, self._print_details, _attempt_suffix(command, 1), stream=self._stdout)
+
+    def retrying(self, task: Task, outcome: Outcome, jobs: int) -> None:
+        command = self._commands[int(task.key)]
+        reason = _describe(_command_result(command, outcome))
+        warn(f"'{command.tag}' {reason}, which looks like it ran out of memory, running it again with jobs lowered to {jobs}")
+        if self._progress is not None:
+            self._progress.write("retrying", tag=command.tag, phase=command.phase, reason=reason, jobs=jobs)
+
+    def finished(self, task: Task, outcome: Outcome) -> None:
+        index = int(task.key)
+        result = _check_budget(_command_result(self._commands[index], outcome), self._over_budget)
+        self.results.append(result)
+        if self._system_log is not None and result.status == Status.FAILED:
+            self._system_log.log("warning" if _allowed_failure(result) else "error", f"'{result.command.tag}' {_describe(result)}")
+        if self._progress is not None:
+            fields = {"tag": result.command.tag, "phase": result.command.phase, "status": _status(result), "exit_code": result.exit_code, "duration": round(result.duration, 3), "attempts": result.attempts}
+            if result.status != Status.SUCCEEDED:
+                fields["reason"] = _describe(result)
+            self._progress.write("finished", **fields)
+        if self._health is not None:
+            self._health.finished(result.command, result.status == Status.SUCCEEDED or _allowed_failure(result))
+        self._on_result(result)
+
+        if not self._buffer_output:
+            if index in self._grouped:
+                self._grouped.discard(index)
+                _end_group(result.command, _attempt_suffix(result.command, result.attempts), _unexpected_failure(result), self._stdout)
+            return
+
+        self._pending[index] = result
+        while self._next in self._pending:
+            result = self._pending.pop(self._next)
+            if result.exit_code is not None and self._slicer is not None:
+                # Slices of the output may have been printed while it ran.
+                released = self._slicer.released(str(self._next))
+                output = (result.output or b"")[released:]
+                if not released or output.strip():
+                    with self._slicer.lock:
+                        self._slicer.print(result.command, output, _attempt_suffix(result.command, result.attempts), released > 0, _unexpected_failure(result))
+            elif result.exit_code is not None:
+                if self._print_command:
+                    _start_group(result.command, self._print_details, _attempt_suffix(result.command, result.attempts), stream=self._stdout)
+                if result.output:
+                    normalize = self._normalizer.normalize if self._normalizer is not None else None
+                    print_output(result.output.strip(), self._stdout, normalize=normalize)
+                if self._print_command:
+                    _end_group(result.command, _attempt_suffix(result.command, result.attempts), _unexpected_failure(result), self._stdout)
+            self._next += 1
+
+
+def _unexpected_failure(result: CommandResult) -> bool:
+    return result.status == Status.FAILED and not _allowed_failure(result)
+
+
+def _signal_name(signum: int) -> str:
+    try:
+        return signal.Signals(signum).name
+    except ValueError:
+        return f"signal {signum}"
+
+
+def _status(result: CommandResult) -> str:
+    """The result's status in results and progress records, where commands
+    that failed by timing out have their own."""
+    if result.status == Status.FAILED and result.timed_out:
+        return "timed_out"
+    if result.skipped is not None:
+        return "skipped"
+    return result.status.value
+
+
+def _allowed_failure(result: CommandResult) -> bool:
+    """Whether the command failed but is allowed to, see allow_failure.
+    Commands that couldn't be started always fail the run."""
+    return result.status == Status.FAILED and result.command.allow_failure and result.error is None
+
+
+def _describe(result: CommandResult) -> str:
+    if result.skipped is not None:
+        return f"skipped, {result.skipped}"
+    if result.status == Status.CANCELLED:
+        return "cancelled"
+    if result.error is not None:
+        return str(result.error)
+    # The duration includes the grace period and any earlier attempts.
+    if result.over_budget:
+        description = f"took {result.duration:.1f}s, over its budget of {result.command.budget:.1f}s"
+    elif result.timed_out and result.command.timeout is not None:
+        description = f"timed out after {result.command.timeout:g}s"
+    elif result.timed_out:
+        description = f"timed out after {result.duration:.1f}s"
+    elif result.signal is not None:
+        description = f"killed by {_signal_name(result.signal)}"
+    else:
+        description = f"failed with exit code {result.exit_code}"
+    if result.attempts > 1 and not result.over_budget:
+        description += f" on all {result.attempts} attempts"
+    if _allowed_failure(result):
+        description += " (allowed)"
+    return description
+
+
+def _in_order(commands: List[Command], results: List[CommandResult]) -> List[CommandResult]:
+    """The results in the order the commands were given."""
+    by_command = {id(result.command): result for result in results}
+    return [by_command[id(command)] for command in commands]
+
+
+def _write_console(stream: TextIO, commands: List[Command], results: List[CommandResult]) -> None:
+    """The summary of the commands that didn't succeed, and of the problems
+    multirun ran into."""
+    # Skipped commands didn't fail.
+    unsuccessful = [result for result in _in_order(commands, results) if result.status != Status.SUCCEEDED and result.skipped is None]
+    if unsuccessful:
+        print(style(f"{len(unsuccessful)} of {len(commands)} commands did not succeed (multirun {_VERSION}):", stream, BOLD, RED), file=stream)
+        for result in unsuccessful:
+            color = YELLOW if result.status == Status.CANCELLED or _allowed_failure(result) else RED
+            print(f"  {style(result.command.tag, stream, BOLD)}: {style(_describe(result), stream, color)}", file=stream)
+    if _problems:
+        print(style(f"multirun ran into problems (multirun {_VERSION}):", stream, BOLD, YELLOW), file=stream)
+        for message in _problems:
+            print(f"  {message}", file=stream)
+    stream.flush()
+
+
+def _annotate(stream: TextIO, commands: List[Command], results: List[CommandResult]) -> None:
+    """Annotate the commands that failed, which CI systems show along with
+    the run."""
+    for result in _in_order(commands, results):
+        if result.status != Status.FAILED:
+            continue
+        message = f"{result.command.tag} {_describe(result)}"
+        if _ci_format == "github":
+            level = "warning" if _allowed_failure(result) else "error"
+            print(f"::{level} title={workflow_escape(result.command.tag, is_property=True)}::{workflow_escape(message)}", file=stream)
+        elif _ci_format == "teamcity" and _allowed_failure(result):
+            print(f"##teamcity[message text='{service_message_escape(message)}' status='WARNING']", file=stream)
+        elif _ci_format == "teamcity":
+            print(f"##teamcity[buildProblem description='{service_message_escape(message)}']", file=stream)
+    stream.flush()
+
+
+def _write_jsonl(stream: TextIO, commands: List[Command], results: List[CommandResult]) -> None:
+    """A JSON object per command."""
+    for result in _in_order(commands, results):
+        entry = {
+            "tag": result.command.tag,
+            "phase": result.command.phase,
+            "status": _status(result),
+            "exit_code": result.exit_code,
+            "duration": round(result.duration, 3),
+            "attempts": result.attempts,
+        }
+        if result.status != Status.SUCCEEDED:
+            entry["reason"] = _describe(result)
+        if _allowed_failure(result):
+            entry["allowed"] = True
+        stream.write(json.dumps(entry, ensure_ascii=False) + "\n")
+
+
+def _write_junit(stream: TextIO, commands: List[Command], results: List[CommandResult]) -> None:
+    """A JUnit XML test suite with a test case per command."""
+    ordered = _in_order(commands, results)
+    suite = ElementTree.Element("testsuite", {
+        "name": "multirun",
+        "tests": str(len(ordered)),
+        "failures": str(sum(1 for result in ordered if result.status == Status.FAILED)),
+        "skipped": str(sum(1 for result in ordered if result.status == Status.CANCELLED)),
+        "time": f"{sum(result.duration for result in ordered):.3f}",
+    })
+    for result in ordered:
+        case = ElementTree.SubElement(suite, "testcase", {
+            "name": result.command.tag,
+            "classname": result.command.phase,
+            "time": f"{result.duration:.3f}",
+        })
+        if result.status == Status.FAILED:
+            ElementTree.SubElement(case, "failure", {"message": _describe(result)})
+        elif result.status == Status.CANCELLED:
+            ElementTree.SubElement(case, "skipped", {"message": _describe(result)})
+        if result.output:
+            ElementTree.SubElement(case, "system-out").text = result.output.decode(errors="replace")
+    stream.write(ElementTree.tostring(suite, encoding="unicode") + "\n")
+
+
+_HTML_STYLE = """
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border-bottom: 1px solid #ddd; padding: 0.3em 1em 0.3em 0; text-align: left; }
+.succeeded { color: #1a7f37; }
+.failed, .timed_out { color: #cf222e; }
+.cancelled { color: #9a6700; }
+.skipped { color: #57606a; }
+.timeline { position: relative; height: 1.4em; margin: 0.2em 0; background: #f6f8fa; }
+.bar { position: absolute; height: 100%; min-width: 2px; overflow: hidden; white-space: nowrap; font-size: 0.8em; color: white; }
+.bar.succeeded { background: #1a7f37; }
+.bar.failed, .bar.timed_out { background: #cf222e; }
+.bar.cancelled { background: #9a6700; }
+pre { background: #f6f8fa; padding: 1em; overflow-x: auto; }
+"""
+
+
+def _write_html(stream: TextIO, commands: List[Command], results: List[CommandResult]) -> None:
+    """A self-contained HTML report with a summary, a timeline, and the
+    output of each command."""
+    ordered = _in_order(commands, results)
+    succeeded = sum(1 for result in ordered if result.status == Status.SUCCEEDED)
+    ran = [result for result in ordered if result.started]
+    begin = min((result.started for result in ran), default=0.0)
+    span = max((result.started + result.duration - begin for result in ran), default=0.0) or 1.0
+
+    lines = [
+        "<!DOCTYPE html>",
+        '<html><head><meta charset="utf-8"><title>multirun results</title>',
+        f"<style>{_HTML_STYLE}</style></head><body>",
+        f"<h1>{succeeded} of {len(ordered)} commands succeeded</h1>",
+        f"<p>multirun {html.escape(_VERSION)}</p>",
+        "<table><tr><th>Command</th><th>Phase</th><th>Status</th><th>Duration</th><th>Attempts</th><th>Reason</th></tr>",
+    ]
+    for result in ordered:
+        status = _status(result)
+        reason = "" if result.status == Status.SUCCEEDED else _describe(result)
+        lines.append(
+            f"<tr><td>{html.escape(result.command.tag)}</td><td>{result.command.phase}</td>"
+            f'<td class="{status}">{status}</td><td>{result.duration:.1f}s</td><td>{result.attempts}</td><td>{html.escape(reason)}</td></tr>'
+        )
+    lines.append("</table>")
+
+    lines.append("<h2>Timeline</h2>")
+    for result in ran:
+        left = (result.started - begin) / span * 100
+        width = result.duration / span * 100
+        title = html.escape(f"{result.command.tag}: {result.started - begin:.1f}s to {result.started - begin + result.duration:.1f}s", quote=True)
+        lines.append(
+            f'<div class="timeline" title="{title}"><div class="bar {_status(result)}" style="left: {left:.2f}%; width: {width:.2f}%">'
+            f"{html.escape(result.command.tag)}</div></div>"
+        )
+
+    lines.append("<h2>Output</h2>")
+    for result in ordered:
+        # Failures are the output people open the report for.
+        attributes = "" if result.status == Status.SUCCEEDED else " open"
+        lines.append(f'<details{attributes}><summary>{html.escape(result.command.tag)}: <span class="{_status(result)}">{_status(result)}</span></summary>')
+        if result.output:
+            lines.append(f"<pre>{html.escape(result.output.decode(errors='replace'))}</pre>")
+        elif not result.started:
+            lines.append("<p>The command didn't run.</p>")
+        elif result.output is None:
+            lines.append("<p>The output wasn't captured, it's only kept with buffer_output.</p>")
+        else:
+            lines.append("<p>The command didn't print anything.</p>")
+        lines.append("</details>")
+    lines.append("</body></html>")
+    stream.write("\n".join(lines) + "\n")
+
+
+ResultsWriter = Callable[[TextIO, List[Command], List[CommandResult]], None]
+
+# Writes the results of a run to a stream, by the name used in
+# MULTIRUN_RESULTS. Console is also how multirun prints its summary.
+RESULTS_WRITERS: Dict[str, ResultsWriter] = {
+    "console": _write_console,
+    "html": _write_html,
+    "jsonl": _write_jsonl,
+    "junit": _write_junit,
+}
+
+
+def register_results_writer(name: str, writer: ResultsWriter) -> None:
+    """Make a results format available to MULTIRUN_RESULTS and --results,
+    for tools that run multirun from Python."""
+    RESULTS_WRITERS[name] = writer
+
+
+def _write_results(destinations: List[Tuple[str, str]], commands: List[Command], results: List[CommandResult]) -> None:
+    """Write the results to each format and path. Failing to write them
+    doesn't change the outcome of the run."""
+    for name, path in destinations:
+        path = os.path.join(_workspace_dir(), path)
         try:
-            _run_command(command, block=True)
-        except subprocess.CalledProcessError:
-            if keep_going:
-                success = False
-            else:
-                return False
-        except KeyboardInterrupt:
+            with open(path, "w", encoding="utf-8") as f:
+                RESULTS_WRITERS[name](f, commands, results)
+        except OSError as e:
+            warn(f"failed to write {name} results to {path}: {e}")
+
+
+# How much longer than before a command has to take to count as slower, so
+# the noise in short commands isn't reported.
+_SLOWER_FACTOR = 1.5
+_SLOWER_SECONDS = 1.0
+
+
+def _read_results(path: str) -> Dict[str, dict]:
+    """The entries of a jsonl results file by tag."""
+    path = os.path.join(_workspace_dir(), path)
+    try:
+        with open(path, encoding="utf-8") as f:
+            entries = [json.loads(line) for line in f if line.strip()]
+        return {entry["tag"]: entry for entry in entries}
+    except OSError as e:
+        raise InstructionsError(f"failed to read results {path}: {e}") from e
+    except (ValueError, KeyError, TypeError) as e:
+        raise InstructionsError(f"invalid results in {path}, expected the jsonl format of MULTIRUN_RESULTS") from e
+
+
+def _compare(old_path: str, new_path: str, stream: TextIO) -> int:
+    """Print which commands newly failed, newly passed, or got slower between
+    two runs' jsonl results, and return 1 if any newly failed.
+
+    Commands that didn't run before, or were skipped, count as newly failing
+    if they failed. Commands skipped now are left out.
+    """
+    old = _read_results(old_path)
+    new = _read_results(new_path)
+    newly_failing = []
+    newly_passing = []
+    slower = []
+    for tag, entry in new.items():
+        if entry["status"] == "skipped":
+            continue
+        before = old.get(tag)
+        if before is not None and before["status"] == "skipped":
+            # Like commands that didn't run before.
+            before = None
+        succeeded = entry["status"] == Status.SUCCEEDED.value
+        succeeded_before = before is not None and before["status"] == Status.SUCCEEDED.value
+        if not succeeded and (before is None or succeeded_before):
+            newly_failing.append(f"{tag}: {entry.get('reason', entry['status'])}")
+        elif succeeded and before is not None and not succeeded_before:
+            newly_passing.append(tag)
+        elif succeeded and succeeded_before and entry["duration"] >= before["duration"] * _SLOWER_FACTOR and entry["duration"] - before["duration"] >= _SLOWER_SECONDS:
+            slower.append(f"{tag}: {before['duration']:.1f}s -> {entry['duration']:.1f}s")
+
+    if not newly_failing and not newly_passing and not slower:
+        print("No commands newly failed, newly passed, or got slower", file=stream)
+    for title, lines, color in (("newly failing", newly_failing, RED), ("newly passing", newly_passing, GREEN), ("slower", slower, YELLOW)):
+        if lines:
+            print(style(f"{len(lines)} {title}:", stream, BOLD, color), file=stream)
+            for line in lines:
+                print(f"  {line}", file=stream)
+    stream.flush()
+    return 1 if newly_failing else 0
+
+
+# How the exit codes of failed commands are combined, see exit_code_policy.
+_EXIT_CODE_POLICIES = ("any", "first_failure", "highest", "count")
+
+
+def _exit_code_policy(name: str, value: Any) -> str:
+    if value not in _EXIT_CODE_POLICIES:
+        raise InstructionsError(f"invalid {name} '{value}': expected one of {', '.join(_EXIT_CODE_POLICIES)}")
+    return value
+
+
+def _exit_code(policy: str, results: List[CommandResult], serial: bool = False) -> int:
+    """Combine the results of commands, in the order they finished, into
+    multirun's exit code.
+
+    Serial runs where a single command failed exit with its exit code with
+    any policy, like running the command by itself would.
+    """
+    for result in results:
+        if result.error is not None:
+            return result.error.exit_code
+
+    # Commands that exited successfully but took too long still fail.
+    failures = [result.exit_code or 1 for result in results if result.status == Status.FAILED and not _allowed_failure(result)]
+    if not failures:
+        return 0
+    if policy == "first_failure" or (serial and len(failures) == 1):
+        return failures[0]
+    if policy == "highest":
+        return max(failures)
+    if policy == "count":
+        return min(len(failures), _MAX_FAILURE_COUNT)
+    return 1
+
+
+class _Deadline:
+    """When the whole run has to be done by, see deadline_seconds."""
+
+    def __init__(self, seconds: float) -> None:
+        self.seconds = seconds
+        self._at = time.monotonic() + seconds
+        # Set once the deadline passed.
+        self.passed = threading.Event()
+
+    def check(self, scheduler: Scheduler) -> bool:
+        """Cancel the scheduler if the deadline passed, and return whether it
+        did."""
+        if time.monotonic() < self._at:
             return False
+        if not self.passed.is_set():
+            self.passed.set()
+            warn(f"the run took longer than its deadline of {self.seconds:g}s, cancelling the remaining commands")
+        scheduler.cancel(f"deadline: the run took longer than {self.seconds:g}s")
+        return True
 
-    return success
 
+class _Restart(threading.Event):
+    """Set to stop the running commands so they can start again."""
 
-def _script_path(workspace_name: str, path: str) -> str:
-    # Even on Windows runfiles require forward slashes.
-    if path.startswith("../"):
-        return _R.Rlocation(path[3:])
-    else:
-        return _R.Rlocation(f"{workspace_name}/{path}")
+    def __init__(self, reason: str) -> None:
+        super().__init__()
+        self.reason = reason
 
 
-def _main(instructions_path: str, extra_args: List[str]) -> None:
-    with open(instructions_path) as f:
-        instructions = json.load(f)
+def _cancel_when(restart: Optional[_Restart], deadline: Optional[_Deadline], scheduler: Scheduler, done: threading.Event) -> None:
+    while not done.wait(timeout=0.1):
+        if restart is not None and restart.is_set():
+            scheduler.cancel(f"restart: {restart.reason}")
+            return
+        if deadline is not None and deadline.check(scheduler):
+            return
 
-    workspace_name = instructions["workspace_name"]
-    commands = [
-        Command(_script_path(workspace_name, blob["path"]), blob["tag"],
-                blob["args"] + extra_args, blob["env"])
-        for blob in instructions["commands"]
+
+def _perform(commands: List[Command], options: _Options, restart: Optional[_Restart] = None, deadline: Optional[_Deadline] = None) -> Optional[List[CommandResult]]:
+    """Run the commands and return their results in the order they finished,
+    or None if interrupted.
+
+    Setting restart, or the deadline passing, cancels the commands that are
+    still running.
+    """
+
+    def on_result(result: CommandResult) -> None:
+        if result.error is not None:
+            # Failing to start a command means the multirun itself is broken,
+            # so it always stops the run.
+            scheduler.cancel(f"failure: '{result.command.tag}' {result.error}")
+        elif result.status == Status.FAILED and not options.keep_going and not _allowed_failure(result):
+            scheduler.cancel(f"failure: '{result.command.tag}' {_describe(result)}")
+
+    def cancel_reason() -> str:
+        # Interrupts cancel the scheduler without a reason.
+        return scheduler.cancel_reason or "interrupt: multirun was interrupted"
+
+    reporter = _Reporter(commands, options, on_result)
+    scheduler = Scheduler(options.jobs, reporter, succeeded=lambda process: process.returncode == 0, capacities=options.resource_capacities, exhausted=_exhausted if options.adaptive_jobs else None)
+    keys = {command.tag: str(index) for index, command in enumerate(commands)}
+    pipeline = _Pipeline(len(commands)) if options.pipeline and commands else None
+    tasks = [
+        _command_task(command, str(index), options, cancel_reason, pipeline)._replace(deps=[keys[tag] for tag in command.deps])
+        for index, command in enumerate(commands)
     ]
-    parallel = instructions["jobs"] == 0
-    print_command: bool = instructions["print_command"]
-    if parallel:
-        success = _perform_concurrently(commands, print_command, instructions["buffer_output"])
-    else:
-        success = _perform_serially(commands, print_command, instructions["keep_going"])
+    done = threading.Event()
+    if deadline is not None:
+        # Nothing starts if an earlier phase already used up the time.
+        deadline.check(scheduler)
+    if restart is not None or deadline is not None:
+        threading.Thread(target=_cancel_when, args=(restart, deadline, scheduler, done), daemon=True).start()
+    try:
+        scheduler.run(tasks)
+    except KeyboardInterrupt:
+        return None
+    finally:
+        done.set()
+        if pipeline is not None:
+            # Commands that never started didn't close theirs.
+            pipeline.close_all()
 
-    sys.exit(0 if success else 1)
+    return reporter.results
 
 
-if __name__ == "__main__":
-    _main(sys.argv[1], sys.argv[2:])
+# The forms of wait_for checks.
+_WAIT_FOR_CHECK = re.compile(r"tcp:.+:[0-9]+|https?://.+")
+# How often wait_for checks are retried, in seconds.
+_WAIT_FOR_INTERVAL = 0.25
+
+
+def _check_passes(check: str) -> bool:
+    """Whether a wait_for check passes: a tcp:HOST:PORT check when the port
+    accepts connections, an http(s) URL when it responds with 200."""
+    if check.startswith(("http://", "https://")):
+        try:
+            with urllib.request.urlopen(check, timeout=1) as response:
+                return response.status == 200
+        except (OSError, http.client.HTTPException):
+            return False
+    host, _, port = check[len("tcp:") :].rpartition(":")
+    try:
+        with socket.create_connection((host, int(port)), timeout=1):
+            return True
+    except OSError:
+        return False
+
+
+def _failing_check(checks: List[str]) -> Optional[str]:
+    for check in checks:
+        if not _check_passes(check):
+            return check
+    return None
+
+
+def _wait_for(command: Command, cancelled: threading.Event) -> None:
+    """Wait until the command's wait_for checks pass.
+
+    Raises:
+        NotReadyError: A check still didn't pass after the ready timeout.
+        Cancelled: The run was cancelled first.
+    """
+    deadline = time.monotonic() + command.ready_timeout
+    while True:
+        check = _failing_check(command.wait_for)
+        if check is None:
+            return
+        if time.monotonic() >= deadline:
+            raise NotReadyError(command, check)
+        if cancelled.wait(_WAIT_FOR_INTERVAL):
+            raise Cancelled()
+
+
+class _ReadyWatcher:
+    """Waits for a background command to be ready: to print a line
+    matching its ready_regex, which it passes through, and to pass its
+    wait_for checks."""
+
+    def __init__(self, command: Command, process: subprocess.Popen, stream: TextIO) -> None:
+        self._command = command
+        self._process = process
+        self._stream = stream
+        self._started = time.monotonic()
+        self._ready = threading.Event()
+        if command.ready_regex is None:
+            self._ready.set()
+        else:
+            self._pattern = re.compile(command.ready_regex)
+            threading.Thread(target=self._run, daemon=True).start()
+
+    def _run(self) -> None:
+        # Streams given by tools that run multirun from Python may only
+        # take text.
+        buffer = getattr(self._stream, "buffer", None)
+        for line in iter(self._process.stdout.readline, b""):
+            if buffer is not None:
+                buffer.write(line)
+                self._stream.flush()
+            else:
+                print_output(line.rstrip(b"\n"), self._stream)
+            if not self._ready.is_set() and self._pattern.search(line.decode(errors="replace")):
+                self._ready.set()
+
+    def wait(self) -> None:
+        """Wait until the command is ready.
+
+        Raises:
+            RunnerError: The command exited or ran out of time first.
+        """
+        deadline = self._started + self._command.ready_timeout
+        while True:
+            # Checks only run once the command printed its ready line.
+            check = _failing_check(self._command.wait_for) if self._ready.is_set() else None
+            if self._ready.is_set() and check is None:
+                return
+            if self._process.poll() is not None:
+                raise RunnerError(f"'{self._command.tag}' exited with code {self._process.returncode} before it was ready")
+            if time.monotonic() >= deadline and check is not None:
+                raise RunnerError(f"'{self._command.tag}': {NotReadyError(self._command, check)}")
+            if time.monotonic() >= deadline:
+                raise RunnerError(f"'{self._command.tag}' didn't print a line matching its ready_regex '{self._command.ready_regex}' within {self._command.ready_timeout:g}s")
+            self._ready.wait(_WAIT_FOR_INTERVAL)
+
+
+def _start_background(commands: List[Command], print_command: bool, print_details: bool, stdout: Optional[TextIO] = None) -> List[Tuple[Command, subprocess.Popen]]:
+    """Start the background commands, and wait until the ones with a
+    ready_regex or wait_for checks are ready. Their output goes to stdout,
+    multirun's own if unset."""
+    started: List[Tuple[Command, subprocess.Popen]] = []
+    watchers = []
+    try:
+        for command in commands:
+            if print_command:
+                _print_tag(command, print_details, " (background)")
+            kwargs: Dict[str, Any] = {} if stdout is None else {"stdout": stdout}
+            if command.ready_regex is not None:
+                kwargs = {"stdout": subprocess.PIPE, "stderr": subprocess.STDOUT}
+            try:
+                # Background commands get their own process group so that
+                # stopping them also stops any processes they started.
+                process = _start_command(command, True, stdin=subprocess.DEVNULL, **kwargs)
+            except OSError as e:
+                raise RunnerError(f"'{command.tag}': {LaunchError(command, e)}") from e
+            started.append((command, process))
+            if command.ready_regex is not None or command.wait_for:
+                watchers.append(_ReadyWatcher(command, process, stdout or sys.stdout))
+        for watcher in watchers:
+            watcher.wait()
+    except (RunnerError, KeyboardInterrupt):
+        _stop_background(started)
+        raise
+    return started
+
+
+def _stop_background(started: List[Tuple[Command, subprocess.Popen]]) -> None:
+    for command, process in started:
+        _sessions.discard(process)
+        returncode = process.poll()
+        if returncode is None:
+            _stop_reason(command, "finished: the other commands finished")
+            _terminate(process, True)
+            try:
+                process.wait(timeout=command.grace_period)
+            except subprocess.TimeoutExpired:
+                pass
+            # Also kills the processes that outlived the command.
+            _kill(process, True)
+            process.wait()
+        if _manifest is not None:
+            _manifest.remove(process)
+        if returncode is not None and returncode != 0:
+            warn(f"background command '{command.tag}' exited early with code {returncode}")
+
+
+def _perform_phases(
+    commands: List[Command],
+    options: _Options,
+    serial_options: _Options,
+    cleanup_options: _Options,
+    restart: Optional[_Restart] = None,
+    deadline: Optional[_Deadline] = None,
+) -> Optional[List[CommandResult]]:
+    """Run the pre commands one at a time, then the main commands if they all
+    succeeded, then the post commands whatever happened.
+
+    Returns the results in the order they finished, or None if any phase was
+    interrupted. Setting restart, or the deadline passing, cancels the pre and
+    main commands, the post commands still run.
+    """
+    # Commands see the output exported by the ones that finished before they
+    # started, in any phase.
+    exports: Dict[str, str] = {}
+    options, serial_options, cleanup_options = (o._replace(exports=exports) for o in (options, serial_options, cleanup_options))
+    pre = [command for command in commands if command.phase == "pre_commands"]
+    main = [command for command in commands if command.phase == "commands"]
+    post = [command for command in commands if command.phase == "post_commands"]
+
+    pre_results = _perform(pre, serial_options, restart, deadline)
+    main_results: Optional[List[CommandResult]] = None
+    if pre_results is not None:
+        if all(result.status == Status.SUCCEEDED or _allowed_failure(result) for result in pre_results):
+            main_results = _perform(main, options, restart, deadline)
+        else:
+            main_results = [CommandResult(command, Status.CANCELLED) for command in main]
+    # Post commands clean up after the others, so they run even if the
+    # others failed or were interrupted.
+    post_results = _perform(post, cleanup_options)
+
+    if pre_results is None or main_results is None or post_results is None:
+        return None
+    return pre_results + main_results + post_results
+
+
+class _Ibazel:
+    """Follows ibazel's notification protocol, enabled for targets tagged
+    ibazel_notify_changes.
+
+    Instead of restarting the multirun after every build, ibazel writes
+    IBAZEL_BUILD_STARTED and IBAZEL_BUILD_COMPLETED lines to its stdin.
+    """
+
+    def __init__(self, stream: Any) -> None:
+        # Set after each successful build.
+        self.rebuilt = _Restart("rebuilt by ibazel")
+        self._closed = threading.Event()
+        threading.Thread(target=self._read, args=(stream,), daemon=True).start()
+
+    def _read(self, stream: Any) -> None:
+        for line in stream:
+            if line.strip() == "IBAZEL_BUILD_COMPLETED SUCCESS":
+                self.rebuilt.set()
+        self._closed.set()
+
+    def wait(self) -> bool:
+        """Wait for the next successful build, False if ibazel went away."""
+        while not self.rebuilt.wait(timeout=0.1):
+            if self._closed.is_set():
+                return self.rebuilt.is_set()
+        return True
+
+
+# How often watched files are checked for changes, and how long they have to
+# stay the same after a change before commands run again, in seconds.
+_WATCH_INTERVAL = 0.5
+_WATCH_DEBOUNCE = 0.3
+
+
+class _Watcher:
+    """Polls the watched files for changes, see watch.
+
+    Editors and formatters often write several files in a row, so changes
+    are only reported once the files stopped changing.
+    """
+
+    def __init__(self, patterns: List[str]) -> None:
+        self._patterns = patterns
+        self._lock = threading.Lock()
+        self._changes: Set[str] = set()
+        # Set once files changed.
+        self.changed = _Restart("files changed")
+        self.count = len(self._scan())
+        threading.Thread(target=self._run, daemon=True).start()
+
+    def _scan(self) -> Dict[str, Tuple[int, int]]:
+        directory = _workspace_dir()
+        snapshot = {}
+        for path in _input_files(directory, self._patterns):
+            try:
+                stat = os.stat(os.path.join(directory, path))
+            except OSError:
+                continue
+            snapshot[path] = (stat.st_mtime_ns, stat.st_size)
+        return snapshot
+
+    @staticmethod
+    def _differences(old: Dict[str, Tuple[int, int]], new: Dict[str, Tuple[int, int]]) -> Set[str]:
+        return {path for path in old.keys() | new.keys() if old.get(path) != new.get(path)}
+
+    def _run(self) -> None:
+        snapshot = self._scan()
+        while True:
+            time.sleep(_WATCH_INTERVAL)
+            current = self._scan()
+            changes = self._differences(snapshot, current)
+            while changes:
+                time.sleep(_WATCH_DEBOUNCE)
+                settled = self._scan()
+                more = self._differences(current, settled)
+                current = settled
+                if not more:
+                    break
+                changes |= more
+            snapshot = current
+            if changes:
+                with self._lock:
+                    self._changes |= changes
+                self.changed.set()
+
+    def take(self) -> Set[str]:
+        """The files that changed since the last call."""
+        with self._lock:
+            changes = self._changes
+            self._changes = set()
+            self.changed.clear()
+        return changes
+
+
+def _affected(commands: List[Command], changes: Set[str], stopped: Set[str]) -> List[Command]:
+    """The commands to run after files changed: pre and post commands, main
+    commands with inputs that changed or without inputs, and main commands
+    the changes stopped. Dependencies on the others are dropped."""
+    tags = {
+        command.tag
+        for command in commands
+        if command.phase == "commands"
+        and (not command.inputs or command.tag in stopped or any(fnmatchcase(path, pattern) for path in changes for pattern in command.inputs))
+    }
+    return [
+        command._replace(deps=[dep for dep in command.deps if dep in tags])
+        for command in commands
+        if command.phase != "commands" or command.tag in tags
+    ]
+
+
+def _describe_changes(changes: Set[str]) -> str:
+    paths = sorted(changes)
+    if len(paths) > 3:
+        return f"{', '.join(paths[:3])} and {len(paths) - 3} more"
+    return ", ".join(paths)
+
+
+def _ibazel() -> Optional[_Ibazel]:
+    if os.environ.pop("IBAZEL_NOTIFY_CHANGES", "") != "y":
+        return None
+    return _Ibazel(sys.stdin)
+
+
+def _runfiles_lookups(rlocation_path: str) -> List[str]:
+    lookups = []
+    manifest = os.environ.get("RUNFILES_MANIFEST_FILE")
+    if manifest:
+        lookups.append(f"looked up {rlocation_path} in the runfiles manifest {manifest}")
+    directory = os.environ.get("RUNFILES_DIR")
+    if directory:
+        lookups.append(f"looked up {rlocation_path} in the runfiles directory {directory}")
+    return lookups or [f"looked up {rlocation_path} next to {sys.argv[0]}"]
+
+
+def _runfiles_roots() -> Optional[List[str]]:
+    """The top level directories of the runfiles tree, None if unknown."""
+    directory = os.environ.get("RUNFILES_DIR")
+    if directory and os.path.isdir(directory):
+        try:
+            return sorted(os.listdir(directory))
+        except OSError as e:
+            _problem(f"failed to list the runfiles directory {directory}: {e}")
+            return None
+    manifest = os.environ.get("RUNFILES_MANIFEST_FILE")
+    if manifest and os.path.isfile(manifest):
+        roots = set()
+        try:
+            with open(manifest, encoding="utf-8") as f:
+                for line in f:
+                    # Lines with escaped paths start with a space.
+                    rlocation_path = line.lstrip(" ").split(" ", 1)[0]
+                    if "/" in rlocation_path:
+                        roots.add(rlocation_path.split("/", 1)[0])
+        except (OSError, UnicodeDecodeError) as e:
+            _problem(f"failed to read the runfiles manifest {manifest}: {e}")
+            return None
+        return sorted(roots)
+    return None
+
+
+def _check_workspace_name(workspace_name: str) -> str:
+    """Return the runfiles directory of the main repository.
+
+    The instructions record ctx.workspace_name, which doesn't always match the
+    runfiles tree, for example when the tree was built by a different Bazel
+    version or with Bzlmod toggled.
+    """
+    roots = _runfiles_roots()
+    if roots is None or workspace_name in roots:
+        return workspace_name
+    # Bzlmod always names the main repository _main.
+    if "_main" in roots:
+        warn(f"workspace '{workspace_name}' is not in the runfiles, using '_main' instead")
+        return "_main"
+    raise RunnerError(
+        f"workspace '{workspace_name}' is not in the runfiles, which contain: {', '.join(roots)}"
+    )
+
+
+def _script_path(workspace_name: str, path: str, tag: str) -> str:
+    # Instructions written for running multirun outside of Bazel can use
+    # absolute paths.
+    if os.path.isabs(path):
+        resolved = path
+        rlocation_path = None
+    elif _R is None:
+        raise RunnerError("runfiles not found, set RUNFILES_DIR or RUNFILES_MANIFEST_FILE")
+    else:
+        # Even on Windows runfiles require forward slashes.
+        if path.startswith("../"):
+            rlocation_path = path[3:]
+        else:
+            rlocation_path = f"{workspace_name}/{path}"
+        resolved = _R.Rlocation(rlocation_path)
+
+    problem = None
+    if not resolved:
+        problem = "could not be resolved"
+    elif not os.path.exists(resolved):
+        problem = f"resolved to {resolved} which does not exist"
+    elif not os.path.isfile(resolved):
+        problem = f"resolved to {resolved} which is not a file"
+    elif platform.system() != "Windows" and not os.access(resolved, os.X_OK):
+        problem = f"resolved to {resolved} which is not executable"
+
+    if problem:
+        raise RunfileNotFoundError(tag, path, problem, _runfiles_lookups(rlocation_path) if rlocation_path else [])
+    return resolved
+
+
+def _runfiles_env() -> Dict[str, str]:
+    """The runfiles variables for commands.
+
+    The multirun's runfiles tree contains the runfiles of every command, so
+    commands use it to find their data. Paths are made absolute because
+    commands may run in a different directory.
+    """
+    if _R is None:
+        return {}
+    return {name: os.path.abspath(value) for name, value in _R.EnvVars().items() if value}
+
+
+def _runfiles_dir() -> Optional[str]:
+    runfiles_env = _runfiles_env()
+    if "RUNFILES_DIR" in runfiles_env:
+        return runfiles_env["RUNFILES_DIR"]
+    manifest = runfiles_env.get("RUNFILES_MANIFEST_FILE", "")
+    if manifest.endswith(".runfiles_manifest"):
+        return manifest[: -len("_manifest")]
+    if os.path.basename(manifest) == "MANIFEST":
+        return os.path.dirname(manifest)
+    return None
+
+
+# Escapes in runfiles manifest lines that start with a space.
+_MANIFEST_ESCAPES = {"\\s": " ", "\\n": "\n", "\\b": "\\"}
+
+
+def _unescape_manifest_path(path: str) -> str:
+    return re.sub(r"\\[snb]", lambda match: _MANIFEST_ESCAPES[match.group()], path)
+
+
+@functools.lru_cache(maxsize=None)
+def _materialized_runfiles() -> str:
+    """A real runfiles directory, for commands whose tools can't read a
+    runfiles manifest.
+
+    When the runfiles only exist as a manifest, like on Windows or with
+    --nobuild_runfile_links, the directory is built in the run directory
+    from symlinks, or copies on Windows where symlinks need privileges, and
+    removed with it.
+    """
+    runfiles_env = _runfiles_env()
+    manifest = runfiles_env.get("RUNFILES_MANIFEST_FILE")
+    if not manifest:
+        directory = runfiles_env.get("RUNFILES_DIR")
+        if not directory:
+            raise RunnerError("runfiles not found, set RUNFILES_DIR or RUNFILES_MANIFEST_FILE")
+        return directory
+
+    directory = os.path.join(_run_dir(), "runfiles")
+    copy = platform.system() == "Windows"
+    try:
+        with open(manifest, encoding="utf-8") as f:
+            for line in f:
+                line = line.rstrip("\n")
+                if not line:
+                    continue
+                escaped = line.startswith(" ")
+                rlocation_path, _, target = (line[1:] if escaped else line).partition(" ")
+                if escaped:
+                    rlocation_path, target = _unescape_manifest_path(rlocation_path), _unescape_manifest_path(target)
+                destination = os.path.join(directory, *rlocation_path.split("/"))
+                os.makedirs(os.path.dirname(destination), exist_ok=True)
+                if not target:
+                    # Empty files, like __init__.py files Bazel adds, have no
+                    # target.
+                    open(destination, "w").close()
+                elif not copy:
+                    os.symlink(target, destination)
+                elif os.path.isdir(target):
+                    shutil.copytree(target, destination)
+                else:
+                    shutil.copy2(target, destination)
+    except OSError as e:
+        raise RunnerError(f"failed to materialize the runfiles of {manifest} in {directory}: {e}") from e
+    return directory
+
+
+def _with_materialized_runfiles(command: Command) -> Command:
+    """Point the command at a real runfiles directory instead of a
+    manifest."""
+    directory = _materialized_runfiles()
+    return command._replace(env=_merge_env(command.env, {
+        "RUNFILES_DIR": directory,
+        "JAVA_RUNFILES": directory,
+        # Runfiles libraries treat empty variables as unset, unlike missing
+        # ones these override multirun's own environment.
+        "RUNFILES_MANIFEST_FILE": "",
+        "RUNFILES_MANIFEST_ONLY": "",
+    }))
+
+
+def _repository_dirs(repositories: Dict[str, str]) -> Dict[str, str]:
+    if not repositories:
+        return {}
+
+    workspace = os.environ.get("BUILD_WORKSPACE_DIRECTORY")
+    if not workspace:
+        raise RunnerError("'repositories' requires BUILD_WORKSPACE_DIRECTORY, run this target with 'bazel run'")
+
+    return {
+        name: os.path.normpath(os.path.join(workspace, path))
+        for name, path in repositories.items()
+    }
+
+
+def _interpreter(path: str) -> Optional[List[str]]:
+    try:
+        with open(path, "rb") as f:
+            first_line = f.readline(256)
+    except OSError:
+        return None
+    if not first_line.startswith(b"#!"):
+        return None
+    return first_line[2:].decode(errors="replace").split()
+
+
+def _preflight(command: Command) -> None:
+    """Check what's needed to start the command, beyond its executable."""
+    problems = []
+    if command.cwd and not os.path.isdir(command.cwd):
+        problems.append(f"working directory {command.cwd} does not exist")
+
+    interpreter = _interpreter(command.path) if platform.system() != "Windows" else None
+    if interpreter:
+        if os.path.basename(interpreter[0]) == "env":
+            names = [arg for arg in interpreter[1:] if not arg.startswith("-") and "=" not in arg]
+            search_path = command.env.get("PATH", os.environ.get("PATH"))
+            if names and not shutil.which(names[0], path=search_path):
+                problems.append(f"interpreter {names[0]} not found in PATH")
+        elif not os.access(interpreter[0], os.X_OK):
+            problems.append(f"interpreter {interpreter[0]} not found or not executable")
+
+    if problems:
+        raise PreflightError(command.tag, problems)
+
+
+_DEFAULT_TAG_TEMPLATE = "Running {label}"
+
+
+def _tag(blob: dict, tag_template: str) -> str:
+    """The command's tag, or one made from the template if it has none.
+
+    Without a label the package and name come from the command's path.
+    Commands expanded from a matrix end with their values.
+    """
+    values = blob.get("matrix_values")
+    suffix = " (" + ", ".join(f"{name}={value}" for name, value in values.items()) + ")" if values else ""
+    if blob.get("tag"):
+        return blob["tag"] + suffix
+
+    path = blob["path"]
+    if path.startswith("../"):
+        repository, _, path = path[3:].partition("/")
+        repository = "@" + repository
+    else:
+        repository = ""
+    package, _, name = path.rpartition("/")
+    name = os.path.splitext(name)[0]
+    label = blob.get("label") or f"{repository}//{package}:{name}"
+    if blob.get("label"):
+        package, _, name = label.partition("//")[2].partition(":")
+    return tag_template.format(label=label, package=package, name=name) + suffix
+
+
+def _check_tag_template(tag_template: str) -> None:
+    try:
+        tag_template.format(label="", package="", name="")
+    except (KeyError, IndexError, ValueError) as e:
+        raise InstructionsError(
+            f"invalid tag_template '{tag_template}', it can only use {{label}}, {{package}} and {{name}}"
+        ) from e
+
+
+def _command(blob: dict, phase: str, workspace_name: str, repository_dirs: Dict[str, str], base_env: Dict[str, str], project_env: Dict[str, str], tag_template: str, extra_args: List[str]) -> Command:
+    tag = _tag(blob, tag_template)
+    path = _script_path(workspace_name, blob["path"], tag)
+    multirun_env = {}
+    cwd = None
+    repository = blob.get("repository")
+    if repository:
+        # Commands run from a different directory so relative runfiles paths
+        # would no longer resolve.
+        path = os.path.abspath(path)
+        cwd = repository_dirs[repository]
+        multirun_env["BUILD_WORKSPACE_DIRECTORY"] = cwd
+        multirun_env["MULTIRUN_REPOSITORY"] = repository
+
+    export_output_as = blob.get("export_output_as") or None
+    if export_output_as is not None and (not re.fullmatch(r"[A-Za-z_][A-Za-z0-9_]*", export_output_as) or export_output_as.upper().startswith("MULTIRUN_")):
+        raise InstructionsError(f"'{tag}': export_output_as '{export_output_as}' is not a valid variable name, or is reserved for multirun")
+
+    resources: Dict[str, int] = {}
+    for resource in blob.get("resources", []):
+        resources[resource] = resources.get(resource, 0) + 1
+
+    timeout = blob.get("timeout_seconds", 0)
+    grace_period = blob.get("grace_period_seconds", 10)
+    if not isinstance(timeout, (int, float)) or timeout < 0:
+        raise InstructionsError(f"'{tag}': timeout_seconds must be at least 0, got {timeout}")
+    if not isinstance(grace_period, (int, float)) or grace_period < 0:
+        raise InstructionsError(f"'{tag}': grace_period_seconds must be at least 0, got {grace_period}")
+    retries = blob.get("retries", 0)
+    retry_backoff = blob.get("retry_backoff", 1)
+    if not isinstance(retries, int) or retries < 0:
+        raise InstructionsError(f"'{tag}': retries must be at least 0, got {retries}")
+    if not isinstance(retry_backoff, (int, float)) or retry_backoff < 0:
+        raise InstructionsError(f"'{tag}': retry_backoff must be at least 0, got {retry_backoff}")
+    if retries and blob.get("background", False):
+        raise InstructionsError(f"'{tag}': background commands can't be retried")
+    priority = blob.get("priority", 0)
+    if not isinstance(priority, int):
+        raise InstructionsError(f"'{tag}': priority must be an integer, got {priority}")
+    ready_regex = blob.get("ready_regex") or None
+    ready_timeout = blob.get("ready_timeout_seconds", 60)
+    if ready_regex is not None:
+        if not blob.get("background", False):
+            raise InstructionsError(f"'{tag}': only background commands can have a ready_regex")
+        try:
+            re.compile(ready_regex)
+        except re.error as e:
+            raise InstructionsError(f"'{tag}': invalid ready_regex '{ready_regex}': {e}") from e
+    wait_for = blob.get("wait_for", [])
+    if not isinstance(wait_for, list):
+        raise InstructionsError(f"'{tag}': wait_for must be a list of checks, got {wait_for!r}")
+    for check in wait_for:
+        if not isinstance(check, str) or not _WAIT_FOR_CHECK.fullmatch(check):
+            raise InstructionsError(f"'{tag}': invalid wait_for check '{check}', expected tcp:HOST:PORT or an http:// or https:// URL")
+    if not isinstance(ready_timeout, (int, float)) or ready_timeout <= 0:
+        raise InstructionsError(f"'{tag}': ready_timeout_seconds must be greater than 0, got {ready_timeout}")
+
+    run_as = None
+    if blob.get("run_as"):
+        run_as, run_as_env = _run_as(tag, blob["run_as"])
+        multirun_env.update(run_as_env)
+
+    env = _merge_env(base_env, blob["env"], _locale_env(blob), project_env, multirun_env)
+    return Command(
+        path,
+        tag,
+        blob["args"] + extra_args,
+        env,
+        cwd,
+        blob.get("stdin", False),
+        blob.get("background", False),
+        phase,
+        export_output_as=export_output_as,
+        resources=resources,
+        mutex=blob.get("mutex") or None,
+        group=blob.get("group") or None,
+        label=blob.get("label", ""),
+        deps=list(blob.get("deps", [])),
+        stage=blob.get("stage", ""),
+        timeout=timeout or None,
+        retries=retries,
+        retry_backoff=retry_backoff,
+        grace_period=grace_period,
+        run_as=run_as,
+        allow_failure=blob.get("allow_failure", False),
+        priority=priority,
+        ready_regex=ready_regex,
+        wait_for=wait_for,
+        ready_timeout=ready_timeout,
+        inputs=list(blob.get("inputs", [])),
+        inputs_key=hashlib.sha256(json.dumps([blob.get("label", ""), blob["path"], blob["args"] + extra_args, blob["env"]], sort_keys=True).encode()).hexdigest(),
+    )
+
+
+def _run_as(tag: str, run_as: str) -> Tuple[Optional[Tuple[int, int, List[int]]], Dict[str, str]]:
+    """Parse a command's run_as, USER[:GROUP] like Docker's user, into what
+    to pass to Popen and the environment that goes with it.
+
+    Users and groups are names or numeric ids. The group defaults to the
+    user's primary group, and users with an entry in the user database also
+    get their supplementary groups and HOME.
+    """
+    if platform.system() == "Windows":
+        raise InstructionsError(f"'{tag}': run_as is only supported on Unix")
+    if sys.version_info < (3, 9):
+        raise InstructionsError(f"'{tag}': run_as needs Python 3.9 or later")
+    # Only exist on Unix.
+    import grp
+    import pwd
+
+    user, _, group = run_as.partition(":")
+    entry = None
+    try:
+        entry = pwd.getpwuid(int(user)) if user.isdigit() else pwd.getpwnam(user)
+    except KeyError:
+        if not user.isdigit():
+            raise InstructionsError(f"'{tag}': run_as user '{user}' doesn't exist") from None
+    uid = int(user) if user.isdigit() else entry.pw_uid
+    if group:
+        try:
+            gid = int(group) if group.isdigit() else grp.getgrnam(group).gr_gid
+        except KeyError:
+            raise InstructionsError(f"'{tag}': run_as group '{group}' doesn't exist") from None
+    elif entry is not None:
+        gid = entry.pw_gid
+    else:
+        raise InstructionsError(f"'{tag}': run_as user {uid} isn't in the user database, give its group too, as {uid}:GROUP")
+
+    if os.geteuid() != 0:
+        if (uid, gid) == (os.geteuid(), os.getegid()):
+            # Already running as them, and changing groups needs root.
+            return None, {}
+        raise InstructionsError(f"'{tag}': run_as needs multirun to run as root")
+    # Don't let the command keep root's supplementary groups.
+    extra_groups = os.getgrouplist(entry.pw_name, gid) if entry is not None else []
+    env = {"HOME": entry.pw_dir} if entry is not None else {}
+    return (uid, gid, extra_groups), env
+
+
+def _locale_env(settings: dict) -> Dict[str, str]:
+    """The variables for the locale and timezone of a command or
+    multirun."""
+    env = {}
+    if settings.get("locale"):
+        env["LANG"] = settings["locale"]
+        env["LC_ALL"] = settings["locale"]
+    if settings.get("timezone"):
+        env["TZ"] = settings["timezone"]
+    return env
+
+
+def _check_resources(commands: List[Command], capacities: Dict[str, int], group_jobs: Dict[str, int]) -> None:
+    problems = [
+        f"resource '{resource}' must have a capacity of at least 1, got {capacity}"
+        for resource, capacity in sorted(capacities.items())
+        if not isinstance(capacity, int) or capacity < 1
+    ]
+    problems += [
+        f"group '{group}' must have jobs of at least 1, got {limit}"
+        for group, limit in sorted(group_jobs.items())
+        if not isinstance(limit, int) or limit < 1
+    ]
+    for command in commands:
+        if command.background and command.resources:
+            problems.append(f"background command '{command.tag}' can't use resources")
+        if command.background and command.mutex:
+            problems.append(f"background command '{command.tag}' can't have a mutex")
+        if command.background and command.group:
+            problems.append(f"background command '{command.tag}' can't be in a group")
+        for resource, amount in sorted(command.resources.items()):
+            capacity = capacities.get(resource, 1)
+            if amount > capacity:
+                problems.append(f"'{command.tag}' uses {amount} of resource '{resource}', which only has a capacity of {capacity}")
+    if problems:
+        raise InstructionsError("invalid resources:\n" + "\n".join(problems))
+
+
+def _mutex_resource(mutex: str) -> str:
+    """The resource a mutex is lowered onto, with a capacity of 1 and apart
+    from the resources commands name themselves."""
+    return f"mutex:{mutex}"
+
+
+def _group_resource(group: str) -> str:
+    """The resource a concurrency group is lowered onto, with the group's
+    jobs as its capacity."""
+    return f"group:{group}"
+
+
+def _resolve_deps(commands: List[Command], known: Set[str]) -> List[Command]:
+    """Replace the names commands depend on with the tags of the commands
+    they select, which are unique by now.
+
+    Names are matched like MULTIRUN_ONLY patterns, without globs. known are
+    the names of every command in the instructions, dependencies on the ones
+    that don't run, for example because of MULTIRUN_SKIP, are dropped.
+    """
+    by_name: Dict[str, List[Command]] = {}
+    for command in commands:
+        for name in set(_names(command, command.label)):
+            by_name.setdefault(name, []).append(command)
+
+    problems = []
+    resolved = []
+    for command in commands:
+        tags: List[str] = []
+        for dep in command.deps:
+            if dep not in by_name and dep not in known:
+                problems.append(f"'{command.tag}' depends on '{dep}', which isn't a command of this multirun")
+            for other in by_name.get(dep, []):
+                if other is command:
+                    problems.append(f"'{command.tag}' depends on itself")
+                elif command.background or other.background:
+                    problems.append(f"'{command.tag}' depends on '{other.tag}', background commands can't have or be dependencies")
+                elif other.phase != command.phase:
+                    problems.append(f"'{command.tag}' in {command.phase} depends on '{other.tag}' in {other.phase}, dependencies have to be in the same list")
+                elif other.tag not in tags:
+                    tags.append(other.tag)
+        resolved.append(command._replace(deps=tags))
+    if problems:
+        raise InstructionsError("invalid deps:\n" + "\n".join(problems))
+    return resolved
+
+
+def _stage_deps(commands: List[Command], stages: List[str]) -> List[Command]:
+    """Make the commands of each stage depend on the commands of the last
+    earlier stage that has any, so stages run one after the other.
+
+    Commands without a stage don't wait for, or hold up, any stage.
+    """
+    problems = []
+    for command in commands:
+        if not command.stage:
+            continue
+        if command.stage not in stages:
+            problems.append(f"'{command.tag}' is in stage '{command.stage}', which isn't one of the stages: " + ", ".join(f"'{stage}'" for stage in stages))
+        elif command.background or command.phase != "commands":
+            problems.append(f"'{command.tag}' is in stage '{command.stage}', but only main commands that don't run in the background can have a stage")
+    if problems:
+        raise InstructionsError("invalid stages:\n" + "\n".join(problems))
+
+    by_stage: Dict[str, List[str]] = {}
+    for command in commands:
+        if command.stage:
+            by_stage.setdefault(command.stage, []).append(command.tag)
+    previous: Dict[str, List[str]] = {}
+    last: List[str] = []
+    for stage in stages:
+        previous[stage] = last
+        last = by_stage.get(stage, last)
+    return [
+        command._replace(deps=command.deps + [tag for tag in previous[command.stage] if tag not in command.deps]) if command.stage else command
+        for command in commands
+    ]
+
+
+def _check_dep_cycles(commands: List[Command]) -> None:
+    by_tag = {command.tag: command for command in commands}
+    visited: Set[str] = set()
+
+    def visit(tag: str, path: List[str]) -> None:
+        if tag in path:
+            cycle = path[path.index(tag) :] + [tag]
+            raise InstructionsError("dependency cycle: " + " -> ".join(f"'{tag}'" for tag in cycle))
+        if tag in visited:
+            return
+        for dep in by_tag[tag].deps:
+            visit(dep, path + [tag])
+        visited.add(tag)
+
+    for command in commands:
+        visit(command.tag, [])
+
+
+_ON_DUPLICATE_TAGS = ("number", "warn", "fail")
+
+
+def _unique_tags(commands: List[Command], on_duplicate: str) -> List[Command]:
+    """Number the commands that have the same tag, see on_duplicate_tags."""
+    counts: Dict[str, int] = {}
+    for command in commands:
+        counts[command.tag] = counts.get(command.tag, 0) + 1
+
+    duplicates = sorted(tag for tag, count in counts.items() if count > 1)
+    if not duplicates:
+        return commands
+    if on_duplicate == "fail":
+        raise InstructionsError("duplicate command tags: " + ", ".join(f"'{tag}'" for tag in duplicates))
+    if on_duplicate == "warn":
+        warn("duplicate command tags, numbering them: " + ", ".join(f"'{tag}'" for tag in duplicates))
+
+    seen: Dict[str, int] = {}
+    unique = []
+    for command in commands:
+        if counts[command.tag] > 1:
+            seen[command.tag] = seen.get(command.tag, 0) + 1
+            command = command._replace(tag=f"{command.tag} #{seen[command.tag]}")
+        unique.append(command)
+    return unique
+
+
+# The schema version written by the current rules. Instructions without a
+# version predate strict parsing and are read leniently.
+_SCHEMA_VERSION = 1
+
+_INSTRUCTIONS_FIELDS = {
+    "adaptive_jobs",
+    "budget_percent",
+    "buffer_output",
+    "changed_files",
+    "commands",
+    "deadline_seconds",
+    "env",
+    "env_file",
+    "exit_code_policy",
+    "fragments",
+    "group_jobs",
+    "health_port",
+    "jobs",
+    "jobs_cpu_percent",
+    "keep_going",
+    "label",
+    "locale",
+    "log_dir",
+    "max_jobs",
+    "normalize_paths",
+    "on_duplicate_tags",
+    "on_empty",
+    "output_format",
+    "output_slice_seconds",
+    "over_budget",
+    "pipeline",
+    "post_commands",
+    "pre_commands",
+    "prefix_output",
+    "preflight",
+    "print_command",
+    "print_command_details",
+    "repeat_seconds",
+    "repositories",
+    "resource_capacities",
+    "shuffle",
+    "stages",
+    "stagger_ms",
+    "stop_on_error",
+    "strict",
+    "system_log",
+    "tag_template",
+    "timestamps",
+    "timezone",
+    "version",
+    "watch",
+    "workspace_name",
+}
+
+_COMMAND_FIELDS = {
+    "allow_failure",
+    "args",
+    "background",
+    "deps",
+    "description",
+    "env",
+    "expected_duration_seconds",
+    "export_output_as",
+    "grace_period_seconds",
+    "group",
+    "inputs",
+    "label",
+    "locale",
+    "materialize_runfiles",
+    "matrix",
+    "mutex",
+    "path",
+    "path_filters",
+    "priority",
+    "ready_regex",
+    "ready_timeout_seconds",
+    "repository",
+    "resources",
+    "retries",
+    "retry_backoff",
+    "run_as",
+    "run_if",
+    "stage",
+    "stdin",
+    "tag",
+    "timeout_seconds",
+    "timezone",
+    "wait_for",
+}
+
+
+# Fragments can only add to the lists and dictionaries of the instructions
+# that reference them.
+_FRAGMENT_FIELDS = {
+    "commands",
+    "env",
+    "post_commands",
+    "pre_commands",
+    "repositories",
+    "version",
+}
+
+
+def _check_fields(instructions_path: str, instructions: dict, fields: Set[str] = _INSTRUCTIONS_FIELDS) -> None:
+    version = instructions.get("version", 0)
+    # JSON booleans are ints to Python, but never a version.
+    if not isinstance(version, int) or isinstance(version, bool) or version > _SCHEMA_VERSION:
+        raise InstructionsError(f"unsupported instructions version {json.dumps(version)} in {instructions_path}, this multirun only supports up to {_SCHEMA_VERSION}")
+    if not instructions.get("strict", version > 0) and fields is _INSTRUCTIONS_FIELDS:
+        return
+
+    unknown = [f"'{field}'" for field in sorted(set(instructions) - fields)]
+    for phase in _PHASES:
+        for index, blob in enumerate(instructions.get(phase, [])):
+            unknown += [f"'{field}' in {phase}[{index}]" for field in sorted(set(blob) - _COMMAND_FIELDS)]
+    if unknown:
+        raise InstructionsError(f"unknown fields in {instructions_path}: " + ", ".join(unknown))
+
+
+def _reject_duplicate_keys(pairs: List[Tuple[str, Any]]) -> dict:
+    result = {}
+    for key, value in pairs:
+        if key in result:
+            # Otherwise the last value would silently win, which is never
+            # what someone writing the same environment variable twice meant.
+            raise ValueError(f"duplicate key '{key}'")
+        result[key] = value
+    return result
+
+
+def _use_launcher_runfiles(launcher: str) -> None:
+    """Fall back to the runfiles next to the launcher.
+
+    Build actions don't set runfiles variables, but tools' runfiles are
+    still next to them.
+    """
+    global _R
+    if _R is not None:
+        return
+    directory = launcher + ".runfiles"
+    manifest = launcher + ".runfiles_manifest"
+    if os.path.isdir(directory):
+        _R = runfiles.CreateDirectoryBased(os.path.abspath(directory))
+    elif os.path.isfile(manifest):
+        _R = runfiles.CreateManifestBased(os.path.abspath(manifest))
+
+
+def _in_build_action() -> bool:
+    """Whether multirun runs as a tool in a build action, rather than with
+    `bazel run` or `bazel test`.
+
+    Actions run in the execroot, which has a bazel-out directory, without a
+    terminal.
+    """
+    if os.environ.get("BUILD_WORKSPACE_DIRECTORY") or os.environ.get("TEST_SRCDIR"):
+        return False
+    return os.path.isdir("bazel-out") and not sys.stdin.isatty()
+
+
+def _find_instructions(argument: str) -> str:
+    """Find the instructions file, trying each location in turn.
+
+    The locations are the launcher's runfiles lookup, the runner's own
+    runfiles lookup, $MULTIRUN_INSTRUCTIONS, and the .json file next to the
+    launcher script.
+    """
+    # These only apply to this multirun, not to any multiruns it runs.
+    rlocation_path = os.environ.pop(_INSTRUCTIONS_RLOCATION_ENV, "")
+    launcher = os.environ.pop(_LAUNCHER_ENV, "")
+    override = os.environ.pop(_INSTRUCTIONS_ENV, "")
+    if launcher:
+        _use_launcher_runfiles(launcher)
+
+    candidates = [
+        ("launcher runfiles lookup", argument),
+        (
+            f"runfiles lookup of {rlocation_path or 'the instructions'}",
+            _R.Rlocation(rlocation_path) if _R is not None and rlocation_path else "",
+        ),
+        (f"${_INSTRUCTIONS_ENV}", override),
+        ("next to the launcher", os.path.splitext(launcher)[0] + ".json" if launcher else ""),
+    ]
+    tried = []
+    for source, path in candidates:
+        if path and os.path.isfile(path):
+            return path
+        tried.append(f"{source}: {path or 'not set'}")
+
+    raise InstructionsError("instructions file not found, tried:" + "".join(f"\n  {t}" for t in tried))
+
+
+def _read_json(path: str) -> dict:
+    try:
+        # Bazel writes the instructions as UTF-8 whatever the platform's
+        # default encoding is.
+        with open(path, encoding="utf-8") as f:
+            value = json.load(f, object_pairs_hook=_reject_duplicate_keys)
+    except (OSError, ValueError) as e:
+        raise InstructionsError(f"failed to load instructions: {e}") from e
+
+    if not isinstance(value, dict):
+        raise InstructionsError(f"invalid instructions in {path}: expected an object")
+    return value
+
+
+def _fragment_path(instructions_path: str, path: str) -> str:
+    """Fragments are given as runfiles paths or relative to the instructions."""
+    if os.path.isabs(path):
+        return path
+    if _R is not None:
+        resolved = _R.Rlocation(path)
+        if resolved and os.path.isfile(resolved):
+            return resolved
+    return os.path.join(os.path.dirname(instructions_path), path)
+
+
+def _merge_fragments(instructions_path: str, instructions: dict) -> dict:
+    """Add the commands and settings of the instructions' fragments.
+
+    Lists are concatenated in order. A key set to different values by
+    different files is an error, rather than one of them silently winning.
+    """
+    merged = dict(instructions)
+    # Where each dictionary entry was set, for conflict errors.
+    sources: Dict[Tuple[str, str], str] = {}
+    for field in ("env", "repositories"):
+        merged[field] = dict(instructions.get(field, {}))
+        for key in merged[field]:
+            sources[(field, key)] = instructions_path
+
+    for path in instructions.get("fragments", []):
+        fragment_path = _fragment_path(instructions_path, path)
+        fragment = _read_json(fragment_path)
+        _check_fields(fragment_path, fragment, _FRAGMENT_FIELDS)
+        for phase in _PHASES:
+            merged[phase] = list(merged.get(phase, [])) + fragment.get(phase, [])
+        for field in ("env", "repositories"):
+            for key, value in fragment.get(field, {}).items():
+                if key in merged[field] and merged[field][key] != value:
+                    raise InstructionsError(
+                        f"'{field}' sets '{key}' to '{merged[field][key]}' in {sources[(field, key)]} "
+                        f"and to '{value}' in {fragment_path}"
+                    )
+                merged[field][key] = value
+                sources[(field, key)] = fragment_path
+
+    return merged
+
+
+def _load_instructions(instructions_path: str) -> dict:
+    instructions = _read_json(instructions_path)
+    _check_fields(instructions_path, instructions)
+    if "fragments" in instructions:
+        instructions = _merge_fragments(instructions_path, instructions)
+    return instructions
+
+
+def _enter(instructions_path: str) -> None:
+    """Record this multirun for its commands, failing if it's already running."""
+    stack = [path for path in os.environ.get(_STACK_ENV, "").split(os.pathsep) if path]
+    current = os.path.realpath(instructions_path)
+    if any(os.path.realpath(path) == current for path in stack):
+        raise CycleError(stack + [current])
+    os.environ[_STACK_ENV] = os.pathsep.join(stack + [current])
+
+
+def _blobs(instructions: dict) -> List[Tuple[str, dict]]:
+    """Every command in the order they run, with the list they came from."""
+    return [
+        (phase, expanded)
+        for phase in _PHASES
+        # Only the main commands are required.
+        for blob in (instructions["commands"] if phase == "commands" else instructions.get(phase, []))
+        for expanded in _expand_matrix(blob)
+    ]
+
+
+def _matrix_variable(name: str) -> str:
+    """The variable with a matrix value, which command scripts expand {name}
+    in their arguments and environment to."""
+    return f"MULTIRUN_MATRIX_{name.upper()}"
+
+
+def _expand_matrix(blob: dict) -> List[dict]:
+    """A command for every combination of the values in its matrix, with the
+    values in their variables.
+
+    {name} in arguments and environment written by hand in the instructions
+    is replaced by the values too. The values are kept in matrix_values for
+    the tag.
+    """
+    matrix = blob.get("matrix")
+    if not matrix:
+        return [blob]
+    for name, values in matrix.items():
+        if not isinstance(values, list) or not values:
+            raise InstructionsError(f"matrix '{name}' of {blob.get('label') or blob['path']} has no values")
+        if not re.fullmatch(r"\w+", name, re.ASCII):
+            raise InstructionsError(f"invalid matrix name '{name}' of {blob.get('label') or blob['path']}, expected letters, digits and underscores")
+
+    def substitute(text: str, values: Dict[str, str]) -> str:
+        for name, value in values.items():
+            text = text.replace(f"{{{name}}}", value)
+        return text
+
+    expanded = []
+    for combination in itertools.product(*matrix.values()):
+        values = dict(zip(matrix, combination))
+        expanded.append(dict(
+            blob,
+            args=[substitute(arg, values) for arg in blob["args"]],
+            env=dict({name: substitute(value, values) for name, value in blob["env"].items()}, **{_matrix_variable(name): value for name, value in values.items()}),
+            matrix_values=values,
+        ))
+    return expanded
+
+
+def _list(instructions_path: str, instructions: dict, output_format: str) -> None:
+    """Print what each command is without running anything."""
+    try:
+        tag_template = instructions.get("tag_template") or _DEFAULT_TAG_TEMPLATE
+        _check_tag_template(tag_template)
+        entries = [
+            {
+                "tag": _tag(blob, tag_template),
+                "description": blob.get("description", ""),
+                "label": blob.get("label", ""),
+                "background": blob.get("background", False),
+                "phase": phase,
+            }
+            for phase, blob in _blobs(instructions)
+        ]
+    except KeyError as e:
+        raise InstructionsError(f"invalid instructions in {instructions_path}: missing {e}") from e
+
+    print_list(entries, output_format, sys.stdout)
+
+
+_PHASES = ("pre_commands", "commands", "post_commands")
+
+
+class _Overrides(NamedTuple):
+    """Settings from MULTIRUN_* environment variables, None when unset."""
+
+    jobs: Optional[int] = None
+    keep_going: Optional[bool] = None
+    quiet: Optional[bool] = None
+    only: Optional[List[str]] = None
+    skip: Optional[List[str]] = None
+    timeout: Optional[float] = None
+    # Timeouts for single commands from MULTIRUN_TIMEOUT_<NAME>, by NAME.
+    command_timeouts: Optional[Dict[str, float]] = None
+    changed: Optional[str] = None
+    env_file: Optional[str] = None
+    # Where to write the results, as (format, path) pairs.
+    results: Optional[List[Tuple[str, str]]] = None
+    # How many seconds the whole run can take.
+    deadline: Optional[float] = None
+    # Whether to stop an earlier run instead of running anything.
+    down: Optional[bool] = None
+    # The file descriptor or path to write progress records to.
+    progress: Optional[str] = None
+    # The port to serve health checks on, 0 to not serve them.
+    health_port: Optional[int] = None
+    exit_code_policy: Optional[str] = None
+    shuffle: Optional[bool] = None
+    # The seed to shuffle commands with, implies shuffle.
+    shuffle_seed: Optional[int] = None
+    # Whether to only run the commands that didn't succeed last time.
+    failed: Optional[bool] = None
+    # How many seconds to wait before running the commands again, 0 to run
+    # them once.
+    repeat: Optional[float] = None
+    # Whether to run commands again when the files they use change.
+    watch: Optional[bool] = None
+    # The format of the progress records written to stdout instead of the
+    # commands' output, see EVENT_FORMATS.
+    events: Optional[str] = None
+    # How to list the commands instead of running them, see LIST_FORMATS.
+    list: Optional[str] = None
+
+
+_TRUE_VALUES = ("1", "true", "yes", "on")
+_FALSE_VALUES = ("0", "false", "no", "off")
+
+
+def _override_bool(name: str, value: str) -> bool:
+    if value.lower() in _TRUE_VALUES:
+        return True
+    if value.lower() in _FALSE_VALUES:
+        return False
+    raise InstructionsError(f"invalid {name} '{value}': expected one of {', '.join(_TRUE_VALUES + _FALSE_VALUES)}")
+
+
+def _override_number(name: str, value: str, parse: Callable[[str], Any], minimum: float, exclusive: bool = False) -> Any:
+    bound = f"greater than {minimum}" if exclusive else f"at least {minimum}"
+    try:
+        number = parse(value)
+    except ValueError:
+        raise InstructionsError(f"invalid {name} '{value}': expected a number {bound}") from None
+    if number < minimum or (exclusive and number == minimum):
+        raise InstructionsError(f"invalid {name} '{value}': expected a number {bound}")
+    return number
+
+
+def _health_port(name: str, value: Any) -> int:
+    port = _override_number(name, str(value), int, 0)
+    if port > 65535:
+        raise InstructionsError(f"invalid {name} '{value}': expected a port number up to 65535")
+    return port
+
+
+# jobs that mean a job per CPU, see jobs_cpu_percent.
+_AUTO_JOBS = -1
+
+
+def _override_jobs(name: str, value: str) -> int:
+    if value == "auto":
+        return _AUTO_JOBS
+    return _override_number(name, value, int, _AUTO_JOBS)
+
+
+def _cpu_jobs(percent: int) -> int:
+    """How many jobs to run for jobs = -1, the percentage of the CPUs
+    multirun can use, at least 1."""
+    # Containers and taskset can limit multirun to some of the machine's
+    # CPUs.
+    if hasattr(os, "sched_getaffinity"):
+        cpus = len(os.sched_getaffinity(0))
+    else:
+        cpus = os.cpu_count() or 1
+    return max(1, cpus * percent // 100)
+
+
+def _override_patterns(value: str) -> List[str]:
+    return [pattern.strip() for pattern in value.split(",") if pattern.strip()]
+
+
+def _override_results(name: str, value: str) -> List[Tuple[str, str]]:
+    destinations = []
+    for entry in value.split(","):
+        writer, separator, path = entry.strip().partition(":")
+        if not separator or not path:
+            raise InstructionsError(f"invalid {name} entry '{entry}', expected FORMAT:PATH")
+        if writer not in RESULTS_WRITERS:
+            raise InstructionsError(f"invalid {name} format '{writer}', expected one of: " + ", ".join(sorted(RESULTS_WRITERS)))
+        destinations.append((writer, path))
+    return destinations
+
+
+def _overrides() -> _Overrides:
+    """Read and remove the MULTIRUN_* variables that override instructions.
+
+    They're removed so that multiruns run as commands don't apply them again.
+    Empty variables count as unset.
+    """
+    values = {name: os.environ.pop(f"MULTIRUN_{name.upper()}", "") for name in ("jobs", "keep_going", "quiet", "only", "skip", "timeout", "deadline", "changed", "env_file", "results", "down", "progress", "health_port", "exit_code_policy", "shuffle", "shuffle_seed", "failed", "repeat", "watch", "events", "list")}
+    overrides = _Overrides()
+    if values["jobs"]:
+        overrides = overrides._replace(jobs=_override_jobs("MULTIRUN_JOBS", values["jobs"]))
+    if values["keep_going"]:
+        overrides = overrides._replace(keep_going=_override_bool("MULTIRUN_KEEP_GOING", values["keep_going"]))
+    if values["quiet"]:
+        overrides = overrides._replace(quiet=_override_bool("MULTIRUN_QUIET", values["quiet"]))
+    if values["only"]:
+        overrides = overrides._replace(only=_override_patterns(values["only"]))
+    if values["skip"]:
+        overrides = overrides._replace(skip=_override_patterns(values["skip"]))
+    if values["timeout"]:
+        overrides = overrides._replace(timeout=_override_number("MULTIRUN_TIMEOUT", values["timeout"], float, 0, exclusive=True))
+    if values["deadline"]:
+        overrides = overrides._replace(deadline=_override_number("MULTIRUN_DEADLINE", values["deadline"], float, 0, exclusive=True))
+    if values["changed"]:
+        overrides = overrides._replace(changed=values["changed"])
+    if values["env_file"]:
+        overrides = overrides._replace(env_file=values["env_file"])
+    if values["results"]:
+        overrides = overrides._replace(results=_override_results("MULTIRUN_RESULTS", values["results"]))
+    if values["down"]:
+        overrides = overrides._replace(down=_override_bool("MULTIRUN_DOWN", values["down"]))
+    if values["progress"]:
+        overrides = overrides._replace(progress=values["progress"])
+    if values["health_port"]:
+        overrides = overrides._replace(health_port=_health_port("MULTIRUN_HEALTH_PORT", values["health_port"]))
+    if values["exit_code_policy"]:
+        overrides = overrides._replace(exit_code_policy=_exit_code_policy("MULTIRUN_EXIT_CODE_POLICY", values["exit_code_policy"]))
+    if values["shuffle"]:
+        overrides = overrides._replace(shuffle=_override_bool("MULTIRUN_SHUFFLE", values["shuffle"]))
+    if values["shuffle_seed"]:
+        overrides = overrides._replace(shuffle_seed=_override_number("MULTIRUN_SHUFFLE_SEED", values["shuffle_seed"], int, 0))
+    if values["failed"]:
+        overrides = overrides._replace(failed=_override_bool("MULTIRUN_FAILED", values["failed"]))
+    if values["repeat"]:
+        overrides = overrides._replace(repeat=_override_number("MULTIRUN_REPEAT", values["repeat"], float, 0))
+    if values["watch"]:
+        overrides = overrides._replace(watch=_override_bool("MULTIRUN_WATCH", values["watch"]))
+    if values["events"]:
+        if values["events"] not in EVENT_FORMATS:
+            raise InstructionsError(f"invalid MULTIRUN_EVENTS '{values['events']}': expected one of {', '.join(EVENT_FORMATS)}")
+        overrides = overrides._replace(events=values["events"])
+    if values["list"]:
+        if values["list"] not in LIST_FORMATS:
+            raise InstructionsError(f"invalid MULTIRUN_LIST '{values['list']}': expected one of {', '.join(LIST_FORMATS)}")
+        overrides = overrides._replace(list=values["list"])
+
+    command_timeouts = {}
+    for variable in [variable for variable in os.environ if variable.startswith(_TIMEOUT_PREFIX)]:
+        value = os.environ.pop(variable)
+        if value:
+            command_timeouts[variable[len(_TIMEOUT_PREFIX) :].upper()] = _override_number(variable, value, float, 0, exclusive=True)
+    if command_timeouts:
+        overrides = overrides._replace(command_timeouts=command_timeouts)
+    return overrides
+
+
+_TIMEOUT_PREFIX = "MULTIRUN_TIMEOUT_"
+
+
+def _cache_dir() -> str:
+    """Where multirun keeps its files, following each platform's
+    conventions for caches unless MULTIRUN_CACHE_DIR is set."""
+    override = os.environ.get("MULTIRUN_CACHE_DIR")
+    if override:
+        return override
+    home = os.path.expanduser("~")
+    system = platform.system()
+    if system == "Windows":
+        return os.path.join(os.environ.get("LOCALAPPDATA") or os.path.join(home, "AppData", "Local"), "multirun", "Cache")
+    if system == "Darwin":
+        return os.path.join(home, "Library", "Caches", "multirun")
+    return os.path.join(os.environ.get("XDG_CACHE_HOME") or os.path.join(home, ".cache"), "multirun")
+
+
+_RUNS_DIR = "runs"
+
+
+@functools.lru_cache(maxsize=None)
+def _run_dir() -> str:
+    """A directory for the files of this run, removed when it ends.
+
+    Run directories are named after the process so that cleaning can tell
+    which ones were left behind by runs that were killed.
+    """
+    runs = os.path.join(_cache_dir(), _RUNS_DIR)
+    try:
+        os.makedirs(runs, exist_ok=True)
+        directory = tempfile.mkdtemp(prefix=f"{os.getpid()}-", dir=runs)
+    except OSError:
+        # Sandboxes and build actions may not have a writable home.
+        directory = tempfile.mkdtemp(prefix="multirun-")
+    # Commands with run_as need to reach the files multirun gives them, like
+    # MULTIRUN_STOP_REASON_FILE, without being able to list the others.
+    os.chmod(directory, 0o711)
+    atexit.register(shutil.rmtree, directory, True)
+    return directory
+
+
+_STACKS_DIR = "stacks"
+
+
+def _start_time(pid: int) -> Optional[str]:
+    """When the process started, to tell it apart from later processes that
+    reuse its pid, where the platform makes that cheap."""
+    try:
+        with open(f"/proc/{pid}/stat", encoding="utf-8") as f:
+            # The command name can contain spaces, the fields after it can't.
+            return f.read().rpartition(")")[2].split()[19]
+    except (OSError, IndexError):
+        return None
+
+
+def _same_process(pid: int, start_time: Optional[str]) -> bool:
+    if platform.system() == "Windows":
+        return True
+    if not _process_running(pid):
+        return False
+    return start_time is None or _start_time(pid) in (None, start_time)
+
+
+class _Manifest:
+    """Records the processes of a run, so that a later run can stop them
+    with MULTIRUN_DOWN even if this one died, see _down.
+
+    It's rewritten whenever a process starts or finishes, and removed when
+    the run ends.
+    """
+
+    def __init__(self, path: str, label: str) -> None:
+        self._path: Optional[str] = path
+        self._lock = threading.Lock()
+        self._data: Dict[str, Any] = {
+            "label": label,
+            "pid": os.getpid(),
+            "start_time": _start_time(os.getpid()),
+            "run_dir": _run_dir(),
+            "processes": {},
+        }
+        with self._lock:
+            self._write()
+
+    def add(self, command: Command, process: subprocess.Popen, process_group: bool) -> None:
+        with self._lock:
+            self._data["processes"][str(process.pid)] = {
+                "tag": command.tag,
+                "process_group": process_group,
+                "start_time": _start_time(process.pid),
+                "stop_reason_file": command.stop_reason_file,
+            }
+            self._write()
+
+    def remove(self, process: subprocess.Popen) -> None:
+        with self._lock:
+            if self._data["processes"].pop(str(process.pid), None) is not None:
+                self._write()
+
+    def close(self) -> None:
+        with self._lock:
+            if self._path is not None:
+                try:
+                    os.remove(self._path)
+                except FileNotFoundError:
+                    pass
+                self._path = None
+
+    def _write(self) -> None:
+        if self._path is None:
+            return
+        temporary = f"{self._path}.{os.getpid()}"
+        try:
+            os.makedirs(os.path.dirname(self._path), exist_ok=True)
+            with open(temporary, "w", encoding="utf-8") as f:
+                json.dump(self._data, f, indent=2)
+            os.replace(temporary, self._path)
+        except OSError as e:
+            warn(f"failed to record the run's processes, MULTIRUN_DOWN won't be able to stop them: {e}")
+            self._path = None
+
+
+# The manifest of the current run, if it's recorded.
+_manifest: Optional[_Manifest] = None
+
+
+def _multirun_digest(instructions_path: str, instructions: dict) -> str:
+    """Names a multirun's files in the cache, the same for every run."""
+    name = instructions.get("label") or os.path.abspath(instructions_path)
+    return hashlib.sha256(name.encode("utf-8")).hexdigest()[:16]
+
+
+def _manifest_prefix(instructions_path: str, instructions: dict) -> str:
+    """The start of the manifest paths of a multirun's runs, which end
+    with the pid of the run so that overlapping runs don't share one."""
+    return os.path.join(_cache_dir(), _STACKS_DIR, f"{_multirun_digest(instructions_path, instructions)}-")
+
+
+_LAST_RESULTS_DIR = "results"
+
+
+def _last_results_path(instructions_path: str, instructions: dict) -> str:
+    """Where the latest result of each of a multirun's commands is kept,
+    in the jsonl format of MULTIRUN_RESULTS, see MULTIRUN_FAILED."""
+    return os.path.join(_cache_dir(), _LAST_RESULTS_DIR, f"{_multirun_digest(instructions_path, instructions)}.jsonl")
+
+
+def _failed_last_time(path: str) -> Optional[Set[str]]:
+    """The tags of the commands that didn't succeed the last time they ran,
+    None if the multirun didn't run before."""
+    if not os.path.exists(path):
+        return None
+    return {
+        tag
+        for tag, entry in _read_results(path).items()
+        if entry.get("phase") == "commands" and entry.get("status") not in ("succeeded", "skipped") and not entry.get("allowed", False)
+    }
+
+
+def _save_last_results(path: str, commands: List[Command], results: List[CommandResult]) -> None:
+    """Record the results of the commands that ran, keeping the earlier
+    results of the others so that commands that still fail are found again
+    after running only some of them."""
+    try:
+        entries = _read_results(path) if os.path.exists(path) else {}
+    except InstructionsError:
+        entries = {}
+    stream = io.StringIO()
+    _write_jsonl(stream, commands, results)
+    for line in stream.getvalue().splitlines():
+        entry = json.loads(line)
+        entries[entry["tag"]] = entry
+    try:
+        os.makedirs(os.path.dirname(path), exist_ok=True)
+        with open(f"{path}.tmp", "w", encoding="utf-8") as f:
+            for entry in entries.values():
+                f.write(json.dumps(entry, ensure_ascii=False) + "\n")
+        os.replace(f"{path}.tmp", path)
+    except OSError as e:
+        warn(f"failed to save the results for MULTIRUN_FAILED to {path}: {e}")
+
+
+def _manifest_paths(prefix: str) -> List[str]:
+    directory, name = os.path.split(prefix)
+    try:
+        return sorted(
+            os.path.join(directory, entry)
+            for entry in os.listdir(directory)
+            if entry.startswith(name) and entry.endswith(".json")
+        )
+    except FileNotFoundError:
+        return []
+
+
+def _read_manifest(path: str) -> Optional[dict]:
+    try:
+        with open(path, encoding="utf-8") as f:
+            return json.load(f)
+    except FileNotFoundError:
+        return None
+    except (OSError, ValueError) as e:
+        raise InstructionsError(f"failed to read the run manifest {path}: {e}") from e
+
+
+def _running_processes(manifest: dict) -> List[Tuple[int, dict]]:
+    """The recorded processes that are still running, multirun's first."""
+    processes = [(manifest["pid"], {"start_time": manifest.get("start_time"), "process_group": False})]
+    processes += [(int(pid), entry) for pid, entry in manifest["processes"].items()]
+    return [(pid, entry) for pid, entry in processes if _same_process(pid, entry.get("start_time"))]
+
+
+def _kill_pid(pid: int, process_group: bool) -> None:
+    if platform.system() == "Windows":
+        subprocess.run(["taskkill", "/F", "/T", "/PID", str(pid)], stdout=subprocess.DEVNULL, stderr=subprocess.DEVNULL)
+        return
+    try:
+        if process_group:
+            os.killpg(pid, signal.SIGKILL)
+        else:
+            os.kill(pid, signal.SIGKILL)
+    except ProcessLookupError:
+        pass
+
+
+def _down(prefix: str) -> None:
+    """Stop the earlier runs of the same multirun, and the processes they
+    started, even if they died without stopping them."""
+    stopped = 0
+    label = None
+    for path in _manifest_paths(prefix):
+        manifest = _read_manifest(path)
+        if manifest is None:
+            continue
+        label = manifest["label"]
+        running = [(pid, entry) for pid, entry in _running_processes(manifest) if pid != os.getpid()]
+        # Multirun is stopped first so it doesn't start anything else.
+        for pid, entry in running:
+            try:
+                _write_reason(entry.get("stop_reason_file"), "down: stopped by MULTIRUN_DOWN")
+            except OSError:
+                pass
+            _kill_pid(pid, entry.get("process_group", False))
+        stopped += len(running)
+        shutil.rmtree(manifest["run_dir"], ignore_errors=True)
+        try:
+            os.remove(path)
+        except FileNotFoundError:
+            pass
+    if label is None:
+        print("Nothing to stop")
+    else:
+        print(f"Stopped {stopped} processes of {label}")
+
+
+def _process_running(pid: int) -> bool:
+    if platform.system() == "Windows":
+        # Files of running processes can't be removed on Windows anyway.
+        return False
+    try:
+        os.kill(pid, 0)
+    except ProcessLookupError:
+        return False
+    except PermissionError:
+        pass
+    return True
+
+
+def _clean() -> None:
+    """Remove the cache, except the directories of runs still going."""
+    cache = _cache_dir()
+    if not os.path.isdir(cache):
+        return
+    for name in os.listdir(cache):
+        path = os.path.join(cache, name)
+        if not os.path.isdir(path):
+            try:
+                os.remove(path)
+            except OSError as e:
+                warn(f"failed to remove {path}: {e}")
+            continue
+        if name == _STACKS_DIR:
+            # Keep what MULTIRUN_DOWN needs to stop runs that are still going.
+            for stack in os.listdir(path):
+                try:
+                    manifest = _read_manifest(os.path.join(path, stack))
+                except InstructionsError:
+                    manifest = None
+                if manifest is None or not _running_processes(manifest):
+                    os.remove(os.path.join(path, stack))
+            continue
+        if name != _RUNS_DIR:
+            shutil.rmtree(path, ignore_errors=True)
+            continue
+        for run in os.listdir(path):
+            pid = run.partition("-")[0]
+            if pid.isdigit() and _process_running(int(pid)):
+                continue
+            shutil.rmtree(os.path.join(path, run), ignore_errors=True)
+    print(f"Cleaned {cache}")
+
+
+def _doctor_runfiles() -> List[Finding]:
+    directory = os.environ.get("RUNFILES_DIR")
+    manifest = os.environ.get("RUNFILES_MANIFEST_FILE")
+    if directory and os.path.isdir(directory):
+        return [Finding("runfiles", "ok", f"directory {directory}")]
+    if not manifest or not os.path.isfile(manifest):
+        return [Finding(
+            "runfiles", "fail", "no runfiles directory or manifest",
+            "run multirun with bazel run, or set RUNFILES_DIR or RUNFILES_MANIFEST_FILE",
+        )]
+
+    findings = [Finding("runfiles", "ok", f"manifest {manifest}")]
+    entries = 0
+    missing = []
+    try:
+        with open(manifest, encoding="utf-8") as f:
+            for line in f:
+                line = line.rstrip("\n")
+                if not line:
+                    continue
+                entries += 1
+                escaped = line.startswith(" ")
+                _, _, target = (line[1:] if escaped else line).partition(" ")
+                if escaped:
+                    target = _unescape_manifest_path(target)
+                if target and not os.path.exists(target):
+                    missing.append(target)
+    except OSError as e:
+        return findings + [Finding("manifest", "fail", f"failed to read {manifest}: {e}")]
+    if missing:
+        findings.append(Finding(
+            "manifest", "fail", f"{len(missing)} of {entries} entries point to missing files, like {missing[0]}",
+            "the manifest is out of date, build the multirun again",
+        ))
+    else:
+        findings.append(Finding("manifest", "ok", f"all {entries} entries exist"))
+    return findings
+
+
+def _doctor_instructions(argument: str) -> List[Finding]:
+    """Whether the instructions are found and their commands resolve."""
+    try:
+        instructions_path = _find_instructions(argument)
+        instructions = _load_instructions(instructions_path)
+    except RunnerError as e:
+        return [Finding("instructions", "fail", str(e), "see Troubleshooting in the README")]
+
+    findings = [Finding("instructions", "ok", instructions_path)]
+    tag_template = instructions.get("tag_template") or _DEFAULT_TAG_TEMPLATE
+    problems = []
+    try:
+        workspace_name = _check_workspace_name(instructions.get("workspace_name", ""))
+    except RunnerError as e:
+        return findings + [Finding("commands", "fail", str(e), "the runfiles are incomplete, build the multirun again")]
+    for _, blob in _blobs(instructions):
+        try:
+            _script_path(workspace_name, blob["path"], _tag(blob, tag_template))
+        except RunnerError as e:
+            problems.append(str(e))
+    if problems:
+        findings.append(Finding(
+            "commands", "fail", "\n".join(problems),
+            "the runfiles are incomplete, build the multirun again",
+        ))
+    else:
+        findings.append(Finding("commands", "ok", "all commands resolve"))
+    return findings
+
+
+def _doctor(argument: Optional[str], stream: TextIO) -> int:
+    """Check the environment multirun runs in, print what's wrong with hints
+    for fixing it, and return 1 if anything failed.
+
+    The instructions are only checked when run through a multirun target.
+    """
+    findings = [check_python()]
+    findings += _doctor_runfiles()
+    findings.append(check_symlinks())
+    if platform.system() == "Windows":
+        findings.append(check_developer_mode())
+    findings += check_shells()
+    findings.append(check_cache_dir(_cache_dir()))
+    if argument is not None:
+        findings += _doctor_instructions(argument)
+    return report(findings, stream)
+
+
+def _workspace_dir() -> str:
+    """Where paths given by users are relative to, the workspace root under
+    `bazel run`."""
+    return os.environ.get("BUILD_WORKSPACE_DIRECTORY") or os.getcwd()
+
+
+def _changed_files(changed: str) -> List[str]:
+    """The files git reports as changed, relative to the workspace root.
+
+    changed is either "staged" or a ref to compare HEAD with.
+    """
+    if changed == "staged":
+        revisions = ["--cached"]
+    else:
+        revisions = [f"{changed}...HEAD"]
+    workspace = _workspace_dir()
+    try:
+        git = subprocess.run(
+            # Deleted files can't be checked.
+            ["git", "diff", "--name-only", "--relative", "--diff-filter=ACMR", "-z"] + revisions + ["--"],
+            cwd=workspace,
+            stdin=subprocess.DEVNULL,
+            stdout=subprocess.PIPE,
+            stderr=subprocess.PIPE,
+        )
+    except OSError as e:
+        raise InstructionsError(f"failed to run git to find the changed files: {e}") from e
+    if git.returncode != 0:
+        raise InstructionsError(f"failed to find the files changed in {workspace} ({changed}): {git.stderr.decode(errors='replace').strip()}")
+    return [path for path in git.stdout.decode(errors="replace").split("\0") if path]
+
+
+def _walk_error(error: OSError) -> None:
+    # Patterns can name directories that don't exist yet.
+    if not isinstance(error, FileNotFoundError):
+        _problem(f"failed to list {error.filename}: {error.strerror}")
+
+
+def _input_files(directory: str, patterns: List[str]) -> List[str]:
+    """The files in directory matching any of the patterns, relative to it
+    with forward slashes, where `*` also matches `/` like in path_filters."""
+    files = set()
+    for pattern in patterns:
+        literal = re.split(r"[*?[]", pattern, maxsplit=1)[0]
+        if literal == pattern:
+            if os.path.isfile(os.path.join(directory, pattern)):
+                files.add(pattern)
+            continue
+        # Only walk the directory the pattern starts with.
+        root = literal.rpartition("/")[0]
+        for dirpath, dirnames, filenames in os.walk(os.path.join(directory, root), onerror=_walk_error):
+            # Symlinks like bazel-out aren't followed.
+            dirnames[:] = [name for name in dirnames if name != ".git"]
+            relative = os.path.relpath(dirpath, directory).replace(os.sep, "/")
+            for name in filenames:
+                path = name if relative == "." else f"{relative}/{name}"
+                if fnmatchcase(path, pattern):
+                    files.add(path)
+    return sorted(files)
+
+
+def _inputs_hash(command: Command) -> str:
+    """A hash of the names and contents of the command's inputs."""
+    directory = _workspace_dir()
+    digest = hashlib.sha256()
+    for path in _input_files(directory, command.inputs):
+        digest.update(path.encode("utf-8") + b"\0")
+        try:
+            with open(os.path.join(directory, path), "rb") as f:
+                for chunk in iter(lambda: f.read(1 << 20), b""):
+                    digest.update(chunk)
+        except OSError:
+            # Files that can't be read never match.
+            digest.update(os.urandom(16))
+        digest.update(b"\0")
+    return digest.hexdigest()
+
+
+_INPUTS_DIR = "inputs"
+
+
+def _inputs_path(instructions_path: str, instructions: dict) -> str:
+    """Where the hashes of the inputs of a multirun's commands are kept,
+    as of when each last succeeded, by inputs_key."""
+    return os.path.join(_cache_dir(), _INPUTS_DIR, f"{_multirun_digest(instructions_path, instructions)}.json")
+
+
+def _read_input_hashes(path: str) -> Dict[str, str]:
+    try:
+        with open(path, encoding="utf-8") as f:
+            hashes = json.load(f)
+    except FileNotFoundError:
+        return {}
+    except (OSError, ValueError) as e:
+        _problem(f"failed to read the inputs of earlier runs from {path}, running every command: {e}")
+        return {}
+    return hashes if isinstance(hashes, dict) else {}
+
+
+def _save_input_hashes(path: str, hashes: Dict[str, str], results: List[CommandResult]) -> None:
+    """Record the inputs of the commands that succeeded, as they are after
+    the command ran so files a formatter fixed don't run it again, and
+    forget them for the commands that didn't."""
+    for result in results:
+        command = result.command
+        if not command.inputs or result.skipped is not None:
+            continue
+        if result.status == Status.SUCCEEDED:
+            hashes[command.inputs_key] = _inputs_hash(command)
+        else:
+            hashes.pop(command.inputs_key, None)
+    try:
+        os.makedirs(os.path.dirname(path), exist_ok=True)
+        with open(f"{path}.tmp", "w", encoding="utf-8") as f:
+            json.dump(hashes, f)
+        os.replace(f"{path}.tmp", path)
+    except OSError as e:
+        warn(f"failed to save the hashes of command inputs to {path}: {e}")
+
+
+def _env_file(env_file: str) -> Dict[str, str]:
+    """The variables in a project's env file, or none if it doesn't exist.
+
+    Relative paths are relative to the workspace root. Lines are NAME=VALUE,
+    optionally prefixed with `export`, values can be in single or double
+    quotes, and blank lines and lines starting with # are ignored. Values
+    aren't expanded.
+    """
+    path = os.path.join(_workspace_dir(), env_file)
+    try:
+        with open(path, encoding="utf-8") as f:
+            lines = f.read().splitlines()
+    except FileNotFoundError:
+        return {}
+    except (OSError, UnicodeDecodeError) as e:
+        raise InstructionsError(f"failed to read {path}: {e}") from e
+
+    env: Dict[str, str] = {}
+    for number, line in enumerate(lines, 1):
+        line = line.strip()
+        if not line or line.startswith("#"):
+            continue
+        if line.startswith("export "):
+            line = line[len("export ") :].lstrip()
+        name, separator, value = line.partition("=")
+        name = name.strip()
+        value = value.strip()
+        if not separator or not re.fullmatch(r"[A-Za-z_][A-Za-z0-9_]*", name):
+            raise InstructionsError(f"{path}:{number}: expected NAME=VALUE, got '{line}'")
+        if len(value) >= 2 and value[0] == value[-1] and value[0] in "'\"":
+            value = value[1:-1]
+        env[name] = value
+    return env
+
+
+def _with_stop_reason_file(command: Command, directory: str, index: int) -> Command:
+    """Give the command a file to read why multirun stopped it from."""
+    path = os.path.join(directory, f"{index}.txt")
+    return command._replace(
+        env=_merge_env(command.env, {"MULTIRUN_STOP_REASON_FILE": path}),
+        stop_reason_file=path,
+    )
+
+
+def _with_changed_files(command: Command, files: List[str], directory: str, index: int) -> Command:
+    """Pass the changed files to the command."""
+    list_path = os.path.join(directory, f"{index}.txt")
+    with open(list_path, "w", encoding="utf-8") as f:
+        f.writelines(f"{path}\n" for path in files)
+    return command._replace(env=_merge_env(command.env, {
+        "MULTIRUN_CHANGED_FILES": "\n".join(files),
+        "MULTIRUN_CHANGED_FILES_LIST": list_path,
+    }))
+
+
+def _names(command: Command, label: str) -> List[str]:
+    """The names that select a command in overrides: the tag, the label, and
+    the label's target name, so they work whichever way Bazel prints labels."""
+    names = [command.tag]
+    if label:
+        names += [label, label.rpartition(":")[2]]
+    return names
+
+
+def _variable_suffix(name: str) -> str:
+    """The name as it appears in variables like MULTIRUN_TIMEOUT_<NAME>."""
+    return re.sub("[^A-Z0-9]", "_", name.upper())
+
+
+def _matches(command: Command, label: str, pattern: str) -> bool:
+    """Whether a MULTIRUN_ONLY or MULTIRUN_SKIP glob selects a command."""
+    return any(fnmatchcase(name, pattern) for name in _names(command, label))
+
+
+def _timeout(command: Command, label: str, overrides: _Overrides, used: Set[str]) -> Optional[float]:
+    """The command's timeout after overrides, recording the
+    MULTIRUN_TIMEOUT_<NAME> variables that applied in used."""
+    for name in _names(command, label):
+        suffix = _variable_suffix(name)
+        if overrides.command_timeouts and suffix in overrides.command_timeouts:
+            used.add(suffix)
+            return overrides.command_timeouts[suffix]
+    if overrides.timeout is not None:
+        return overrides.timeout
+    return command.timeout
+
+
+def _check_pipeline(commands: List[Command]) -> None:
+    """Reject commands that can't be part of a pipeline, where they all run
+    at once and exactly once."""
+    for command in commands:
+        for unsupported, value in (
+            ("deps", command.deps),
+            ("a stage", command.stage),
+            ("retries", command.retries),
+            ("resources", command.resources),
+            ("a mutex", command.mutex),
+            ("a group", command.group),
+            ("export_output_as", command.export_output_as),
+        ):
+            if value:
+                raise InstructionsError(f"'{command.tag}': commands in a pipeline can't have {unsupported}")
+
+
+def _shuffle(commands: List[Command], seed: Optional[int]) -> List[Command]:
+    """Shuffle the main commands, printing the seed so the order can be
+    repeated. Pre and post commands keep their order."""
+    if seed is None:
+        seed = random.randrange(2**32)
+    print(f"Shuffling commands with seed {seed}, MULTIRUN_SHUFFLE_SEED={seed} runs them in the same order", file=sys.stderr, flush=True)
+    main = [command for command in commands if command.phase == "commands"]
+    random.Random(seed).shuffle(main)
+    shuffled = iter(main)
+    return [next(shuffled) if command.phase == "commands" else command for command in commands]
+
+
+def _selected(command: Command, label: str, overrides: _Overrides, matched: Set[str]) -> bool:
+    """Whether a main command runs given MULTIRUN_ONLY and MULTIRUN_SKIP.
+
+    Records the MULTIRUN_ONLY patterns that matched in matched.
+    """
+    if overrides.skip and any(_matches(command, label, pattern) for pattern in overrides.skip):
+        return False
+    if overrides.only is None:
+        return True
+    selected = [pattern for pattern in overrides.only if _matches(command, label, pattern)]
+    matched.update(selected)
+    return bool(selected)
+
+
+# Operating system and architecture names used by run_if, by what platform
+# reports.
+_OS_NAMES = {"darwin": "macos"}
+_ARCH_NAMES = {"amd64": "x86_64", "x64": "x86_64", "aarch64": "arm64"}
+
+
+def _condition_holds(tag: str, condition: str) -> bool:
+    negated = condition.startswith("!")
+    kind, separator, value = condition[1 if negated else 0 :].partition(":")
+    if not separator or not value:
+        kind = ""
+    if kind == "env":
+        name, equals, expected = value.partition("=")
+        holds = os.environ.get(name) == expected if equals else name in os.environ
+    elif kind == "os":
+        system = platform.system().lower()
+        holds = _OS_NAMES.get(system, system) == value
+    elif kind == "arch":
+        machine = platform.machine().lower()
+        holds = _ARCH_NAMES.get(machine, machine) == value
+    elif kind == "file":
+        holds = os.path.exists(os.path.join(_workspace_dir(), value))
+    else:
+        raise InstructionsError(f"'{tag}': invalid run_if condition '{condition}', expected env:NAME, env:NAME=VALUE, os:NAME, arch:NAME, or file:PATH")
+    return holds != negated
+
+
+def _unmet_condition(tag: str, conditions: List[str]) -> Optional[str]:
+    """The first of a command's run_if conditions that doesn't hold, None if
+    they all do and the command runs."""
+    for condition in conditions:
+        if not _condition_holds(tag, condition):
+            return condition
+    return None
+
+
+def _version() -> str:
+    return "\n".join([
+        f"multirun {_VERSION}",
+        f"commit: {_COMMIT or 'unknown'}",
+        f"instructions schema version: {_SCHEMA_VERSION}",
+        f"python: {platform.python_version()}",
+    ])
+
+
+class _CleanAction(argparse.Action):
+    """Cleans the cache and exits, without needing --instructions, like
+    --version."""
+
+    def __init__(self, option_strings: List[str], dest: str, **kwargs: Any) -> None:
+        super().__init__(option_strings, dest, nargs=0, **kwargs)
+
+    def __call__(self, parser: argparse.ArgumentParser, *args: Any) -> None:
+        _clean()
+        parser.exit()
+
+
+class _DoctorAction(argparse.Action):
+    """Checks the environment and exits, without needing --instructions."""
+
+    def __init__(self, option_strings: List[str], dest: str, **kwargs: Any) -> None:
+        super().__init__(option_strings, dest, nargs=0, **kwargs)
+
+    def __call__(self, parser: argparse.ArgumentParser, *args: Any) -> None:
+        parser.exit(_doctor(None, sys.stdout))
+
+
+class _CompareAction(argparse.Action):
+    """Compares two runs' results and exits, without needing --instructions."""
+
+    def __init__(self, option_strings: List[str], dest: str, **kwargs: Any) -> None:
+        super().__init__(option_strings, dest, nargs=2, metavar=("OLD", "NEW"), **kwargs)
+
+    def __call__(self, parser: argparse.ArgumentParser, namespace: argparse.Namespace, values: Any, *args: Any) -> None:
+        parser.exit(_compare(values[0], values[1], sys.stdout))
+
+
+class _FlagParser(argparse.ArgumentParser):
+    def error(self, message: str) -> NoReturn:
+        raise InstructionsError(f"{message}\n{self.format_usage().strip()}")
+
+
+def _parse_flags(argv: List[str]) -> Tuple[str, List[str], _Overrides]:
+    """Parse the flags for running multirun directly rather than through a
+    multirun target's launcher.
+
+    Returns the instructions path, the arguments for every command, which
+    come after --, and the overrides.
+    """
+    extra_args: List[str] = []
+    if "--" in argv:
+        argv, extra_args = argv[: argv.index("--")], argv[argv.index("--") + 1 :]
+    parser = _FlagParser(prog="multirun", description="Run the commands in a multirun instructions file.", formatter_class=argparse.RawTextHelpFormatter)
+    parser.add_argument("--version", action="version", version=_version())
+    parser.add_argument("--clean", action=_CleanAction, help="like MULTIRUN_CLEAN")
+    parser.add_argument("--compare", action=_CompareAction, help="like MULTIRUN_COMPARE")
+    parser.add_argument("--doctor", action=_DoctorAction, help="like MULTIRUN_DOCTOR")
+    parser.add_argument("--instructions", required=True, help="the instructions file to run")
+    parser.add_argument("--jobs", help="like MULTIRUN_JOBS")
+    parser.add_argument("--keep-going", action="store_true", default=None, help="like MULTIRUN_KEEP_GOING")
+    parser.add_argument("--quiet", action="store_true", default=None, help="like MULTIRUN_QUIET")
+    parser.add_argument("--only", help="like MULTIRUN_ONLY")
+    parser.add_argument("--skip", help="like MULTIRUN_SKIP")
+    parser.add_argument("--failed", action="store_true", default=None, help="like MULTIRUN_FAILED")
+    parser.add_argument("--timeout", help="like MULTIRUN_TIMEOUT")
+    parser.add_argument("--deadline", help="like MULTIRUN_DEADLINE")
+    parser.add_argument("--repeat", help="like MULTIRUN_REPEAT")
+    parser.add_argument("--watch", action="store_true", default=None, help="like MULTIRUN_WATCH")
+    parser.add_argument("--exit-code-policy", choices=_EXIT_CODE_POLICIES, help="like MULTIRUN_EXIT_CODE_POLICY")
+    parser.add_argument("--changed", help="like MULTIRUN_CHANGED")
+    parser.add_argument("--results", help="like MULTIRUN_RESULTS")
+    parser.add_argument("--down", action="store_true", default=None, help="like MULTIRUN_DOWN")
+    parser.add_argument("--progress", help="like MULTIRUN_PROGRESS")
+    parser.add_argument("--events", choices=EVENT_FORMATS, help="like MULTIRUN_EVENTS")
+    parser.add_argument("--list", nargs="?", const="table", choices=LIST_FORMATS, help="like MULTIRUN_LIST")
+    flags = parser.parse_args(argv)
+
+    overrides = _Overrides(
+        jobs=None if flags.jobs is None else _override_jobs("--jobs", flags.jobs),
+        keep_going=flags.keep_going,
+        quiet=flags.quiet,
+        only=None if flags.only is None else _override_patterns(flags.only),
+        skip=None if flags.skip is None else _override_patterns(flags.skip),
+        failed=flags.failed,
+        timeout=None if flags.timeout is None else _override_number("--timeout", flags.timeout, float, 0, exclusive=True),
+        deadline=None if flags.deadline is None else _override_number("--deadline", flags.deadline, float, 0, exclusive=True),
+        repeat=None if flags.repeat is None else _override_number("--repeat", flags.repeat, float, 0),
+        watch=flags.watch,
+        exit_code_policy=flags.exit_code_policy,
+        changed=flags.changed,
+        results=None if flags.results is None else _override_results("--results", flags.results),
+        down=flags.down,
+        progress=flags.progress,
+        events=flags.events,
+        list=flags.list,
+    )
+    return flags.instructions, extra_args, overrides
+
+
+class _Settings(NamedTuple):
+    """How a multirun runs, from its instructions with the overrides applied."""
+
+    workspace_name: str
+    jobs: int
+    print_command: bool
+    print_details: bool
+    keep_going: bool
+    stop_on_error: bool
+    buffer_output: bool
+    pipeline: bool
+    # Whether the main commands run in a random order.
+    shuffle: bool
+    prefix_output: bool
+    timestamps: str
+    log_dir: str
+    exit_code_policy: str
+    health_port: int
+    output_slice_seconds: float
+    stagger_ms: float
+    deadline_seconds: float
+    repeat_seconds: float
+    on_duplicate_tags: str
+    on_empty: str
+    output_format: str
+    over_budget: str
+    system_log: Optional[_SystemLog]
+    normalizer: Optional[_PathNormalizer]
+
+
+def _settings(instructions_path: str, instructions: dict, overrides: _Overrides) -> _Settings:
+    """Read the multirun's settings, raising InstructionsError for invalid ones."""
+    workspace_name = instructions["workspace_name"]
+    # Only paths in the main repository use the workspace name.
+    if any(not blob["path"].startswith("../") and not os.path.isabs(blob["path"]) for _, blob in _blobs(instructions)):
+        workspace_name = _check_workspace_name(workspace_name)
+    jobs: int = instructions["jobs"]
+    print_command: bool = instructions["print_command"]
+    print_details = instructions.get("print_command_details", False)
+    keep_going: bool = instructions["keep_going"]
+    stop_on_error = instructions.get("stop_on_error", False)
+    buffer_output: bool = instructions["buffer_output"]
+    pipeline = instructions.get("pipeline", False)
+    timestamps = instructions.get("timestamps", "none")
+    if timestamps not in _TIMESTAMPS:
+        raise InstructionsError(f"invalid timestamps '{timestamps}': expected one of {', '.join(_TIMESTAMPS)}")
+    exit_code_policy = overrides.exit_code_policy or _exit_code_policy("exit_code_policy", instructions.get("exit_code_policy", "any"))
+    health_port = _health_port("health_port", instructions.get("health_port", 0))
+    output_slice_seconds = instructions.get("output_slice_seconds", 0)
+    if not isinstance(output_slice_seconds, (int, float)) or output_slice_seconds < 0:
+        raise InstructionsError(f"output_slice_seconds must be at least 0, got {output_slice_seconds}")
+    stagger_ms = instructions.get("stagger_ms", 0)
+    if not isinstance(stagger_ms, (int, float)) or stagger_ms < 0:
+        raise InstructionsError(f"stagger_ms must be at least 0, got {stagger_ms}")
+    deadline_seconds = instructions.get("deadline_seconds", 0)
+    if not isinstance(deadline_seconds, (int, float)) or deadline_seconds < 0:
+        raise InstructionsError(f"deadline_seconds must be at least 0, got {deadline_seconds}")
+    repeat_seconds = instructions.get("repeat_seconds", 0)
+    if not isinstance(repeat_seconds, (int, float)) or repeat_seconds < 0:
+        raise InstructionsError(f"repeat_seconds must be at least 0, got {repeat_seconds}")
+    on_duplicate_tags = instructions.get("on_duplicate_tags", "warn")
+    if on_duplicate_tags not in _ON_DUPLICATE_TAGS:
+        raise InstructionsError(f"invalid on_duplicate_tags '{on_duplicate_tags}': expected one of {', '.join(_ON_DUPLICATE_TAGS)}")
+    output_format = instructions.get("output_format", "auto")
+    if output_format not in OUTPUT_FORMATS:
+        raise InstructionsError(f"invalid output_format '{output_format}': expected one of {', '.join(OUTPUT_FORMATS)}")
+    system_log = _SystemLog(instructions.get("label") or instructions_path) if instructions.get("system_log", False) else None
+    if system_log is not None:
+        # Problems found while loading the instructions.
+        for message in _problems:
+            system_log.log("warning", message)
+        global _system_log
+        _system_log = system_log
+    normalizer = None
+    if instructions.get("normalize_paths", False):
+        normalizer = _PathNormalizer(workspace_name, _runfiles_dir(), os.environ.get("BUILD_WORKSPACE_DIRECTORY"))
+
+    if overrides.jobs is not None:
+        jobs = overrides.jobs
+    if jobs == _AUTO_JOBS:
+        jobs = _cpu_jobs(instructions.get("jobs_cpu_percent", 100))
+    max_jobs = instructions.get("max_jobs", 0)
+    if max_jobs and (jobs == 0 or jobs > max_jobs):
+        if overrides.jobs is not None:
+            warn(f"limiting jobs to the multirun's max_jobs of {max_jobs}")
+        jobs = max_jobs
+    if overrides.keep_going is not None:
+        keep_going = overrides.keep_going
+        # Asking to keep going also keeps parallel commands going.
+        stop_on_error = stop_on_error and not keep_going
+    if overrides.deadline is not None:
+        deadline_seconds = overrides.deadline
+    if overrides.repeat is not None:
+        repeat_seconds = overrides.repeat
+    if overrides.health_port is not None:
+        health_port = overrides.health_port
+    if overrides.quiet:
+        print_command = False
+        print_details = False
+    shuffle = instructions.get("shuffle", False) if overrides.shuffle is None else overrides.shuffle
+    if pipeline:
+        # Every command of a pipeline runs at once, in the order given.
+        jobs = 0
+        buffer_output = False
+    if overrides.events:
+        if pipeline:
+            raise InstructionsError("pipelines can't write events, the last command writes to stdout")
+        if overrides.progress is not None:
+            raise InstructionsError("MULTIRUN_EVENTS writes progress records to stdout, it can't be used with MULTIRUN_PROGRESS")
+        # Records replace multirun's own output on stdout.
+        print_command = False
+        buffer_output = False
+    return _Settings(
+        workspace_name=workspace_name,
+        jobs=jobs,
+        print_command=print_command,
+        print_details=print_details,
+        keep_going=keep_going,
+        stop_on_error=stop_on_error,
+        buffer_output=buffer_output,
+        pipeline=pipeline,
+        shuffle=(shuffle or overrides.shuffle_seed is not None) and not pipeline,
+        prefix_output=instructions.get("prefix_output", False),
+        timestamps=timestamps,
+        log_dir=instructions.get("log_dir", ""),
+        exit_code_policy=exit_code_policy,
+        health_port=health_port,
+        output_slice_seconds=output_slice_seconds,
+        stagger_ms=stagger_ms,
+        deadline_seconds=deadline_seconds,
+        repeat_seconds=repeat_seconds,
+        on_duplicate_tags=on_duplicate_tags,
+        on_empty=instructions.get("on_empty", "warn"),
+        output_format=output_format,
+        over_budget=instructions.get("over_budget", "warn"),
+        system_log=system_log,
+        normalizer=normalizer,
+    )
+
+
+def _load_commands(
+    instructions: dict,
+    extra_args: List[str],
+    overrides: _Overrides,
+    settings: _Settings,
+    input_hashes: Optional[Dict[str, str]],
+    failed_tags: Optional[Set[str]],
+) -> Tuple[List[Command], List[Command], List[CommandResult]]:
+    """Return the commands to run, the background commands and the results of
+    commands that are skipped.
+
+    Raises CommandsError with every command that can't be run.
+    """
+    repository_dirs = _repository_dirs(instructions.get("repositories", {}))
+    base_env = _merge_env(_color_env(), _runfiles_env(), instructions.get("env", {}), _locale_env(instructions))
+    env_file = overrides.env_file or instructions.get("env_file", "")
+    project_env = _env_file(env_file) if env_file else {}
+    tag_template = instructions.get("tag_template") or _DEFAULT_TAG_TEMPLATE
+    _check_tag_template(tag_template)
+    preflight = instructions.get("preflight", True)
+    budget_percent = instructions.get("budget_percent", 200)
+    commands = []
+    # Commands whose run_if conditions don't hold.
+    skipped: List[CommandResult] = []
+    errors: List[RunnerError] = []
+    matched: Set[str] = set()
+    known_names: Set[str] = set()
+    used_timeouts: Set[str] = set()
+    changed = overrides.changed or instructions.get("changed_files") or "all"
+    changed_files = None
+    changed_files_dir = ""
+    if changed != "all":
+        changed_files = _changed_files(changed)
+        changed_files_dir = os.path.join(_run_dir(), "changed")
+        os.makedirs(changed_files_dir)
+    for position, (phase, blob) in enumerate(_blobs(instructions)):
+        try:
+            command = _command(blob, phase, settings.workspace_name, repository_dirs, base_env, project_env, tag_template, extra_args)
+            # Colors follow the instructions rather than the selection,
+            # so commands keep theirs when others are left out.
+            command = command._replace(color=PREFIX_COLORS[position % len(PREFIX_COLORS)])
+            known_names.update(_names(command, command.label))
+            if phase == "commands" and not _selected(command, blob.get("label", ""), overrides, matched):
+                continue
+            if phase == "commands" and changed_files is not None:
+                path_filters = blob.get("path_filters", [])
+                files = [path for path in changed_files if not path_filters or any(fnmatchcase(path, pattern) for pattern in path_filters)]
+                if path_filters and not files:
+                    continue
+                command = _with_changed_files(command, files, changed_files_dir, len(commands))
+            unmet = _unmet_condition(command.tag, blob.get("run_if", []))
+            if unmet is not None:
+                skipped.append(CommandResult(command, Status.CANCELLED, skipped=f"run_if {unmet} doesn't hold"))
+                continue
+            if command.inputs and input_hashes is not None and input_hashes.get(command.inputs_key) == _inputs_hash(command):
+                skipped.append(CommandResult(command, Status.CANCELLED, skipped="inputs unchanged since it last succeeded"))
+                continue
+            if not command.background:
+                command = command._replace(timeout=_timeout(command, blob.get("label", ""), overrides, used_timeouts))
+            if blob.get("materialize_runfiles", False):
+                command = _with_materialized_runfiles(command)
+            if preflight:
+                _preflight(command)
+            expected_duration = blob.get("expected_duration_seconds", 0)
+            if expected_duration:
+                command = command._replace(budget=expected_duration * budget_percent / 100)
+            commands.append(command)
+        except RunnerError as e:
+            errors.append(e)
+
+    if errors:
+        raise CommandsError(errors)
+    unmatched = [pattern for pattern in overrides.only or [] if pattern not in matched]
+    if unmatched:
+        raise InstructionsError("MULTIRUN_ONLY patterns matched no commands: " + ", ".join(f"'{pattern}'" for pattern in unmatched))
+    for suffix in sorted(set(overrides.command_timeouts or {}) - used_timeouts):
+        warn(f"{_TIMEOUT_PREFIX}{suffix} doesn't match any command")
+    commands = _unique_tags(commands, settings.on_duplicate_tags)
+    if failed_tags is not None:
+        # Commands with duplicate tags are only told apart once they're
+        # numbered, like in the results of the last run.
+        commands = [command for command in commands if command.phase != "commands" or command.tag in failed_tags]
+        skipped = [result for result in skipped if result.command.tag in failed_tags]
+    commands = _resolve_deps(commands, known_names)
+    commands = _stage_deps(commands, instructions.get("stages", []))
+    _check_dep_cycles(commands)
+    _check_resources(commands, instructions.get("resource_capacities", {}), instructions.get("group_jobs", {}))
+    stop_reasons_dir = os.path.join(_run_dir(), "stop")
+    os.makedirs(stop_reasons_dir)
+    commands = [_with_stop_reason_file(command, stop_reasons_dir, index) for index, command in enumerate(commands)]
+
+    stdin_tags = [f"'{command.tag}'" for command in commands if command.stdin]
+    if len(stdin_tags) > 1:
+        raise InstructionsError("at most one command can read stdin, got " + ", ".join(stdin_tags))
+    background_stdin_tags = [f"'{command.tag}'" for command in commands if command.stdin and command.background]
+    if background_stdin_tags:
+        raise InstructionsError("background commands can't read stdin, got " + ", ".join(background_stdin_tags))
+
+    background = [command for command in commands if command.background]
+    commands = [command for command in commands if not command.background]
+    if not commands:
+        # With nothing else to wait for, background commands run like the
+        # others, until they exit or the multirun is interrupted.
+        commands, background = background, []
+    if settings.pipeline:
+        _check_pipeline([command for command in commands if command.phase == "commands"])
+    elif settings.shuffle:
+        commands = _shuffle(commands, overrides.shuffle_seed)
+    return commands, background, skipped
+
+
+def _build_options(
+    settings: _Settings,
+    instructions: dict,
+    commands: List[Command],
+    interactive: bool,
+    restartable: bool,
+    progress: Optional[Progress],
+    health: Optional[_Health],
+    events: bool,
+) -> Tuple[_Options, _Options, _Options]:
+    """Return the options for the main commands, the pre commands and the post
+    commands."""
+    resource_capacities = instructions.get("resource_capacities", {})
+    group_jobs = instructions.get("group_jobs", {})
+    resource_capacities = dict(resource_capacities, **{_mutex_resource(command.mutex): 1 for command in commands if command.mutex})
+    # Groups without jobs of their own are only limited by jobs.
+    resource_capacities.update({
+        _group_resource(command.group): group_jobs.get(command.group, len(commands))
+        for command in commands
+        if command.group
+    })
+    main_count = sum(1 for command in commands if command.phase == "commands")
+    print_command = settings.print_command
+    print_details = settings.print_details
+    over_budget = settings.over_budget
+    system_log = settings.system_log
+    all_options = tuple(options._replace(progress=progress, health=health, restartable=restartable) for options in (
+        _options(settings.jobs, main_count, print_command, print_details, settings.keep_going, settings.buffer_output, over_budget, interactive, system_log, settings.normalizer, settings.stop_on_error)._replace(resource_capacities=resource_capacities, adaptive_jobs=instructions.get("adaptive_jobs", False)),
+        _options(1, 1, print_command, print_details, False, False, over_budget, interactive, system_log),
+        _options(1, 1, print_command, print_details, True, False, over_budget, interactive, system_log),
+    ))
+    if settings.output_slice_seconds and all_options[0].buffer_output:
+        main_options = all_options[0]
+        slicer = _OutputSlicer(settings.output_slice_seconds, main_options.print_command, main_options.print_details, main_options.normalizer, main_options.stdout)
+        all_options = (main_options._replace(slicer=slicer),) + all_options[1:]
+    if settings.stagger_ms and all_options[0].parallel:
+        all_options = (all_options[0]._replace(stagger=_Stagger(settings.stagger_ms / 1000)),) + all_options[1:]
+    if settings.pipeline:
+        all_options = (all_options[0]._replace(pipeline=True),) + all_options[1:]
+    # Only the output of concurrent commands would interleave.
+    if settings.prefix_output and all_options[0].parallel and not all_options[0].buffer_output and not settings.pipeline:
+        all_options = (all_options[0]._replace(prefix_output=True),) + all_options[1:]
+    # Buffered output is printed long after it was written.
+    if settings.timestamps != "none" and not settings.pipeline:
+        stamps = _Timestamps(settings.timestamps)
+        all_options = tuple(options if options.buffer_output else options._replace(timestamps=stamps) for options in all_options)
+    if events:
+        all_options = tuple(options._replace(events=True) for options in all_options)
+    if settings.log_dir:
+        directory = _log_dir(settings.log_dir)
+        # Commands in a pipeline write to each other.
+        all_options = tuple(options if options.pipeline else options._replace(log_dir=directory) for options in all_options)
+    return all_options
+
+
+def _execute(
+    instructions_path: str,
+    instructions: dict,
+    overrides: _Overrides,
+    settings: _Settings,
+    commands: List[Command],
+    background: List[Command],
+    skipped: List[CommandResult],
+    input_hashes: Optional[Dict[str, str]],
+) -> NoReturn:
+    """Run the commands, again after changes when watching or repeating, and
+    exit with the multirun's exit code."""
+    if hasattr(signal, "SIGWINCH"):
+        signal.signal(signal.SIGWINCH, _forward_resize)
+    # CI systems cancel jobs with SIGTERM, which would otherwise leave the
+    # commands running. Commands running in parallel have their own process
+    # groups, so they don't get it.
+    signal.signal(signal.SIGTERM, signal.default_int_handler)
+    ibazel = _ibazel()
+    # Under ibazel stdin carries its notifications, not input for commands.
+    interactive = ibazel is None and not _in_build_action()
+    progress = None if overrides.progress is None else _progress(overrides.progress)
+    if overrides.events:
+        progress = _progress(str(sys.stdout.fileno()))
+    health = _Health(settings.health_port) if settings.health_port else None
+    all_options = _build_options(settings, instructions, commands, interactive, ibazel is not None, progress, health, bool(overrides.events))
+    manifest_prefix = _manifest_prefix(instructions_path, instructions)
+    for path in _manifest_paths(manifest_prefix):
+        try:
+            earlier = _read_manifest(path)
+        except InstructionsError:
+            continue
+        if earlier is not None and _running_processes(earlier):
+            warn("an earlier run of this multirun is still running, stop it with MULTIRUN_DOWN=1")
+            break
+    global _ci_format
+    _ci_format = detect_ci() if settings.output_format == "auto" else None if settings.output_format == "plain" else settings.output_format
+    global _manifest
+    _manifest = _Manifest(f"{manifest_prefix}{os.getpid()}.json", instructions.get("label") or instructions_path)
+    atexit.register(_manifest.close)
+    # ibazel already watches the sources.
+    watch = instructions.get("watch", [])
+    watcher = None
+    if ibazel is None and interactive and (overrides.watch if overrides.watch is not None else bool(watch)):
+        patterns = watch + [pattern for command in commands for pattern in command.inputs]
+        if not patterns:
+            raise InstructionsError("there's nothing to watch, set the multirun's watch or the commands' inputs")
+        watcher = _Watcher(patterns)
+    restart = ibazel.rebuilt if ibazel is not None else watcher.changed if watcher is not None else None
+    print_command = settings.print_command
+    system_log = settings.system_log
+    last_results_path = _last_results_path(instructions_path, instructions)
+    inputs_path = _inputs_path(instructions_path, instructions)
+    all_commands = commands
+    iteration = 1
+    while True:
+        if restart is not None:
+            restart.clear()
+        if system_log is not None:
+            system_log.log("info", f"started {len(commands) + len(background)} commands")
+        if progress is not None:
+            progress.write("run_started", commands=len(commands), background=len(background))
+        deadline = _Deadline(settings.deadline_seconds) if settings.deadline_seconds else None
+        started = _start_background(background, print_command, settings.print_details, sys.stderr if overrides.events else None)
+        if health is not None:
+            health.run_started(commands, started)
+        try:
+            results = _perform_phases(commands, *all_options, restart, deadline)
+        finally:
+            if health is not None:
+                health.run_finished()
+            _stop_background(started)
+
+        if results is None:
+            if system_log is not None:
+                system_log.log("warning", "interrupted")
+            if progress is not None:
+                progress.write("run_finished", exit_code=1, interrupted=True)
+            sys.exit(1)
+
+        exit_code = _exit_code(settings.exit_code_policy, results, serial=settings.jobs == 1)
+        if deadline is not None and deadline.passed.is_set():
+            exit_code = _EXIT_DEADLINE
+        if system_log is not None:
+            system_log.log("info" if exit_code == 0 else "warning", f"finished with exit code {exit_code}")
+        if progress is not None:
+            progress.write("run_finished", exit_code=exit_code, interrupted=False)
+        # Commands cancelled for a restart didn't fail.
+        if restart is None or not restart.is_set():
+            _write_console(sys.stderr, commands + [result.command for result in skipped], results + skipped)
+            # Annotations are workflow commands, which are read from stdout.
+            if not overrides.events:
+                _annotate(sys.stdout, commands, results)
+        if overrides.results:
+            _write_results(overrides.results, commands + [result.command for result in skipped], results + skipped)
+        if not _in_build_action():
+            _save_last_results(last_results_path, commands + [result.command for result in skipped], results + skipped)
+        if input_hashes is not None and any(command.inputs for command in commands):
+            _save_input_hashes(inputs_path, input_hashes, results)
+        if watcher is not None:
+            stopped = {result.command.tag for result in results if result.status == Status.CANCELLED and result.skipped is None}
+            if not watcher.changed.is_set() and print_command:
+                print(f"Watching {watcher.count} files for changes", flush=True)
+            try:
+                while True:
+                    while not watcher.changed.wait(0.1):
+                        pass
+                    changes = watcher.take()
+                    commands = _affected(all_commands, changes, stopped)
+                    if any(command.phase == "commands" for command in commands):
+                        break
+            except KeyboardInterrupt:
+                sys.exit(exit_code)
+            if print_command:
+                print(f"Running again after changes to {_describe_changes(changes)}", flush=True)
+            continue
+        if ibazel is None and settings.repeat_seconds:
+            try:
+                time.sleep(settings.repeat_seconds)
+            except KeyboardInterrupt:
+                sys.exit(exit_code)
+            iteration += 1
+            if print_command:
+                print(f"--- Run {iteration} at {time.strftime('%H:%M:%S')} ---", flush=True)
+            continue
+        if ibazel is None:
+            sys.exit(exit_code)
+        try:
+            rebuilt = ibazel.wait()
+        except KeyboardInterrupt:
+            rebuilt = False
+        if not rebuilt:
+            sys.exit(exit_code)
+        if print_command:
+            print("Restarting after rebuild", flush=True)
+
+
+def _main(argument: str, extra_args: List[str], flags: Optional[_Overrides] = None) -> None:
+    """Run a multirun.
+
+    Flags are only given when multirun was run directly, then argument is the
+    instructions path from --instructions.
+    """
+    # Multirun targets pass all their arguments to commands, so the version
+    # is asked for with a variable.
+    if os.environ.pop("MULTIRUN_VERSION", ""):
+        print(_version())
+        return
+    if os.environ.pop("MULTIRUN_CLEAN", ""):
+        _clean()
+        return
+    if os.environ.pop("MULTIRUN_DOCTOR", ""):
+        sys.exit(_doctor(argument if flags is None else None, sys.stdout))
+    compare = os.environ.pop("MULTIRUN_COMPARE", "")
+    if compare:
+        old_path, separator, new_path = compare.partition(",")
+        if not separator or not old_path or not new_path:
+            raise InstructionsError(f"invalid MULTIRUN_COMPARE '{compare}', expected OLD,NEW")
+        sys.exit(_compare(old_path, new_path, sys.stdout))
+    if flags is None:
+        instructions_path = _find_instructions(argument)
+    elif os.path.isfile(argument):
+        instructions_path = argument
+    else:
+        raise InstructionsError(f"instructions file not found: {argument}")
+    _enter(instructions_path)
+    instructions = _load_instructions(instructions_path)
+    overrides = _overrides()
+    if flags is not None:
+        # Flags are more specific than the environment.
+        overrides = overrides._replace(**{name: value for name, value in flags._asdict().items() if value is not None})
+    if overrides.list:
+        _list(instructions_path, instructions, overrides.list)
+        return
+    if overrides.down:
+        _down(_manifest_prefix(instructions_path, instructions))
+        return
+    # Commands with inputs always run in build actions, which don't keep
+    # anything between runs.
+    input_hashes = None if _in_build_action() else _read_input_hashes(_inputs_path(instructions_path, instructions))
+    failed_tags = None
+    if overrides.failed:
+        failed_tags = _failed_last_time(_last_results_path(instructions_path, instructions))
+        if failed_tags is None:
+            warn("this multirun didn't run before, running every command")
+        elif not failed_tags:
+            print("No commands failed the last time they ran", file=sys.stderr)
+            return
+
+    try:
+        settings = _settings(instructions_path, instructions, overrides)
+        commands, background, skipped = _load_commands(instructions, extra_args, overrides, settings, input_hashes, failed_tags)
+    except KeyError as e:
+        raise InstructionsError(f"invalid instructions in {instructions_path}: missing {e}") from e
+
+    if settings.print_command:
+        for result in skipped:
+            _print_tag(result.command, False, f" ({_describe(result)})")
+    if not commands:
+        # Commands that were skipped don't make the multirun empty.
+        if settings.on_empty == "fail" and not skipped:
+            raise InstructionsError("there are no commands to run")
+        if settings.on_empty == "warn" and not skipped:
+            warn("there are no commands to run")
+        sys.exit(0)
+
+    if platform.system() == "Windows":
+        _bash()
+
+    if settings.jobs < 0:
+        raise InstructionsError(f"jobs must be at least 0, got {settings.jobs}")
+
+    _execute(instructions_path, instructions, overrides, settings, commands, background, skipped, input_hashes)
+
+
+if __name__ == "__main__":
+    # Tags can contain anything, don't crash on consoles that can't show them.
+    for stream in (sys.stdout, sys.stderr):
+        if hasattr(stream, "reconfigure"):
+            stream.reconfigure(errors="replace")
+
+    try:
+        # Launchers always pass the instructions path first.
+        if len(sys.argv) < 2 or sys.argv[1].startswith("-"):
+            _main(*_parse_flags(sys.argv[1:]))
+        else:
+            _main(sys.argv[1], sys.argv[2:])
+    except RunnerError as e:
+        print(f"{style('error:', sys.stderr, BOLD, RED)} {e}", file=sys.stderr)
+        sys.exit(_EXIT_RUNNER_ERROR)
@@ -0,0 +1,140 @@
+"""
+How multirun prints its own output: colors, lines that can't crash the run
+whatever their encoding, and the sections CI systems collapse output into.
+
+Nothing here knows about commands, titles and details are plain text, so
+tools that run multirun from Python can print like it does.
+"""
+
+import functools
+import os
+import platform
+import sys
+from typing import Callable, Optional, TextIO
+
+
+def _forced(name: str) -> bool:
+    return os.environ.get(name, "0") not in ("", "0")
+
+
+@functools.lru_cache(maxsize=None)
+def use_color(stream: TextIO) -> bool:
+    """Whether multirun's own output to the stream is colored.
+
+    NO_COLOR wins over FORCE_COLOR and CLICOLOR_FORCE, which win over dumb
+    terminals and output that doesn't go to a terminal. Windows consoles
+    only get colors when they're forced.
+    """
+    if os.environ.get("NO_COLOR"):
+        return False
+    if _forced("FORCE_COLOR") or _forced("CLICOLOR_FORCE"):
+        return True
+    if os.environ.get("TERM") == "dumb" or platform.system() == "Windows":
+        return False
+    return stream.isatty()
+
+
+BOLD = "1"
+RED = "31"
+GREEN = "32"
+YELLOW = "33"
+# Told apart from each other and from errors, bright colors repeat the
+# normal ones for multiruns with many commands.
+PREFIX_COLORS = ("36", "33", "32", "35", "34", "96", "93", "92", "95", "94")
+
+
+def style(text: str, stream: TextIO, *codes: str) -> str:
+    if not use_color(stream):
+        return text
+    return f"\033[{';'.join(codes)}m{text}\033[0m"
+
+
+def print_line(text: str, stream: TextIO) -> None:
+    """Print a line to a stream that may not be able to encode all of it,
+    like one given by a tool that runs multirun from Python."""
+    try:
+        stream.write(text + "\n")
+    except UnicodeEncodeError:
+        encoding = getattr(stream, "encoding", None) or "utf-8"
+        stream.write((text + "\n").encode(encoding, errors="replace").decode(encoding))
+    stream.flush()
+
+
+def print_output(output: bytes, stream: TextIO, prefix: str = "", normalize: Optional[Callable[[str], str]] = None) -> None:
+    """Print what a command wrote, after the prefix and normalized if given.
+
+    Commands can write in any encoding, or none, so what isn't UTF-8 is
+    replaced rather than crashing the run.
+    """
+    text = output.decode(errors="replace")
+    if normalize is not None:
+        text = normalize(text)
+    print_line(prefix + text, stream)
+
+
+def print_tag(title: str, details: Optional[str], stream: TextIO) -> None:
+    print_line(style(title, stream, BOLD), stream)
+    if details is not None:
+        print_line(details, stream)
+
+
+def warn(message: str) -> None:
+    print(f"{style('warning:', sys.stderr, BOLD, YELLOW)} {message}", file=sys.stderr, flush=True)
+
+
+OUTPUT_FORMATS = ("auto", "plain", "github", "buildkite", "teamcity")
+
+
+def detect_ci() -> Optional[str]:
+    """The CI system multirun runs in, if its logs can group the output of
+    each command."""
+    if os.environ.get("GITHUB_ACTIONS") == "true":
+        return "github"
+    if os.environ.get("BUILDKITE") == "true":
+        return "buildkite"
+    if os.environ.get("TEAMCITY_VERSION"):
+        return "teamcity"
+    return None
+
+
+def workflow_escape(value: str, is_property: bool = False) -> str:
+    """Escape a value in a GitHub Actions workflow command."""
+    value = value.replace("%", "%25").replace("\r", "%0D").replace("\n", "%0A")
+    if is_property:
+        value = value.replace(":", "%3A").replace(",", "%2C")
+    return value
+
+
+def service_message_escape(value: str) -> str:
+    """Escape a value in a TeamCity service message."""
+    for character, escaped in (("|", "||"), ("'", "|'"), ("\n", "|n"), ("\r", "|r"), ("[", "|["), ("]", "|]")):
+        value = value.replace(character, escaped)
+    return value
+
+
+def start_group(title: str, details: Optional[str], ci_format: Optional[str], stream: TextIO) -> None:
+    """Print the title before a command's output, in the logs of ci_format
+    as the title of a section the output can be collapsed into until
+    end_group."""
+    if ci_format == "github":
+        print_line(f"::group::{workflow_escape(title)}", stream)
+    elif ci_format == "buildkite":
+        print_line(f"--- {title}", stream)
+    elif ci_format == "teamcity":
+        print_line(f"##teamcity[blockOpened name='{service_message_escape(title)}']", stream)
+    else:
+        print_tag(title, details, stream)
+        return
+    if details is not None:
+        print_line(details, stream)
+
+
+def end_group(title: str, failed: bool, ci_format: Optional[str], stream: TextIO) -> None:
+    """End the section of a command's output, Buildkite expands the ones of
+    failed commands."""
+    if ci_format == "github":
+        print_line("::endgroup::", stream)
+    elif ci_format == "buildkite" and failed:
+        print_line("^^^ +++", stream)
+    elif ci_format == "teamcity":
+        print_line(f"##teamcity[blockClosed name='{service_message_escape(title)}']", stream)
@@ -0,0 +1,319 @@
+"""
+A dependency-aware scheduler with bounded concurrency and cancellation.
+
+The scheduler knows nothing about processes, tasks are plain callables, so it
+can be reused by other tools to schedule any kind of work. The multirun runner
+is a thin wrapper around it.
+"""
+
+import heapq
+import threading
+from enum import Enum
+from typing import Any, Callable, Dict, Iterable, List, Mapping, NamedTuple, Optional, Protocol, Sequence, Tuple
+
+
+class Status(Enum):
+    SUCCEEDED = "succeeded"
+    FAILED = "failed"
+    # The task was stopped or never started, either because the run was
+    # cancelled or because one of its dependencies did not succeed.
+    CANCELLED = "cancelled"
+
+
+class Cancelled(Exception):
+    """Raised by tasks that stopped early because the run was cancelled."""
+
+    def __init__(self, value: Any = None) -> None:
+        super().__init__("cancelled")
+        # What the task had produced when it stopped, if anything.
+        self.value = value
+
+
+class Task(NamedTuple):
+    key: str
+    # Called on a worker thread with an event that is set when the run is
+    # cancelled. Long running work should poll it, stop promptly, and raise
+    # Cancelled.
+    run: Callable[[threading.Event], Any]
+    deps: Sequence[str] = ()
+    # Ready tasks with a higher priority are started first, ties are broken
+    # by the order the tasks were given in.
+    priority: int = 0
+    # How much of each named resource the task holds while it runs. Tasks
+    # wait until enough of their resources are free, see capacities.
+    resources: Mapping[str, int] = {}
+
+
+class Outcome(NamedTuple):
+    status: Status
+    # The value returned by the task, or the exception it raised.
+    value: Any = None
+
+
+class Sink(Protocol):
+    """Receives task lifecycle events, always on the scheduling thread."""
+
+    def started(self, task: Task) -> None:
+        ...
+
+    def finished(self, task: Task, outcome: Outcome) -> None:
+        ...
+
+    def retrying(self, task: Task, outcome: Outcome, jobs: int) -> None:
+        """The task failed by running out of a shared resource and will be
+        started again once fewer than jobs tasks are running."""
+        ...
+
+
+class _NullSink:
+    def started(self, task: Task) -> None:
+        pass
+
+    def finished(self, task: Task, outcome: Outcome) -> None:
+        pass
+
+    def retrying(self, task: Task, outcome: Outcome, jobs: int) -> None:
+        pass
+
+
+class Scheduler:
+    """Runs tasks from a source in dependency order.
+
+    Args:
+        jobs: The maximum number of tasks running at once, 0 means unlimited.
+        sink: Receives started and finished events for every task.
+        succeeded: Decides whether a task's return value counts as success.
+            Tasks that raise always fail.
+        capacities: How much of each resource there is. Resources that
+            aren't listed have a capacity of 1, so tasks using them never
+            overlap.
+        exhausted: Decides whether a failed task's return value shows it ran
+            out of something every task shares, like memory. Those tasks are
+            run again with half as many jobs as they started with, until
+            only one task runs at a time.
+    """
+
+    def __init__(
+        self,
+        jobs: int = 0,
+        sink: Optional[Sink] = None,
+        succeeded: Callable[[Any], bool] = lambda _: True,
+        capacities: Optional[Mapping[str, int]] = None,
+        exhausted: Optional[Callable[[Any], bool]] = None,
+    ) -> None:
+        if jobs < 0:
+            raise ValueError(f"jobs must be at least 0, got {jobs}")
+        for resource, capacity in (capacities or {}).items():
+            if capacity < 1:
+                raise ValueError(f"resource {resource} must have a capacity of at least 1, got {capacity}")
+        self._jobs = jobs
+        self._capacities = dict(capacities or {})
+        self._sink = sink or _NullSink()
+        self._succeeded = succeeded
+        self._exhausted = exhausted
+        self._cancelled = threading.Event()
+        self._cancel_reason: Any = None
+        self._done = threading.Condition()
+        self._finished: List[Tuple[Task, Outcome]] = []
+
+    @property
+    def cancelled(self) -> threading.Event:
+        return self._cancelled
+
+    @property
+    def cancel_reason(self) -> Any:
+        """The reason given when the run was first cancelled, None if it
+        wasn't cancelled, wasn't given one, or was interrupted."""
+        return self._cancel_reason
+
+    def cancel(self, reason: Any = None) -> None:
+        """Stop starting new tasks and signal running tasks to stop.
+
+        Tasks can read the reason from cancel_reason, for example to tell
+        the work they're stopping why. Later reasons are ignored.
+        """
+        with self._done:
+            if not self._cancelled.is_set():
+                self._cancel_reason = reason
+            self._cancelled.set()
+            self._done.notify_all()
+
+    def run(self, source: Iterable[Task]) -> Dict[str, Outcome]:
+        """Run every task from the source and return their outcomes by key.
+
+        If interrupted with KeyboardInterrupt the run is cancelled, running
+        tasks are waited for, and the interrupt is re-raised.
+        """
+        tasks = list(source)
+        by_key = _validate(tasks, self._capacities)
+        order = {task.key: index for index, task in enumerate(tasks)}
+        dependents: Dict[str, List[str]] = {task.key: [] for task in tasks}
+        waiting = {task.key: len(set(task.deps)) for task in tasks}
+        for task in tasks:
+            for dep in set(task.deps):
+                dependents[dep].append(task.key)
+
+        ready: List[Tuple[int, int, str]] = []
+        for task in tasks:
+            if waiting[task.key] == 0:
+                heapq.heappush(ready, (-task.priority, order[task.key], task.key))
+
+        outcomes: Dict[str, Outcome] = {}
+        running = 0
+        in_use: Dict[str, int] = {}
+
+        def available(task: Task) -> bool:
+            return all(
+                in_use.get(resource, 0) + amount <= self._capacities.get(resource, 1)
+                for resource, amount in task.resources.items()
+            )
+
+        def hold(task: Task, sign: int) -> None:
+            for resource, amount in task.resources.items():
+                in_use[resource] = in_use.get(resource, 0) + sign * amount
+
+        # How many tasks could run at once when each running task started.
+        started_with: Dict[str, int] = {}
+
+        def lower_jobs(key: str) -> bool:
+            """Lower jobs below what the task started with, returning
+            whether it can run again."""
+            if self._jobs and self._jobs < started_with[key]:
+                # Another task already lowered them.
+                return True
+            if started_with[key] <= 1:
+                return False
+            self._jobs = started_with[key] // 2
+            return True
+
+        def resolve(key: str, outcome: Outcome) -> None:
+            outcomes[key] = outcome
+            for dependent in dependents[key]:
+                if dependent in outcomes:
+                    continue
+                if outcome.status != Status.SUCCEEDED:
+                    skipped = Outcome(Status.CANCELLED)
+                    self._sink.finished(by_key[dependent], skipped)
+                    resolve(dependent, skipped)
+                    continue
+                waiting[dependent] -= 1
+                if waiting[dependent] == 0:
+                    task = by_key[dependent]
+                    heapq.heappush(ready, (-task.priority, order[dependent], dependent))
+
+        try:
+            while len(outcomes) < len(tasks):
+                # Tasks waiting for resources are set aside so the tasks
+                # after them can start.
+                waiting_for_resources = []
+                while ready and not self._cancelled.is_set() and (self._jobs == 0 or running < self._jobs):
+                    entry = heapq.heappop(ready)
+                    key = entry[2]
+                    if key in outcomes:
+                        continue
+                    task = by_key[key]
+                    if not available(task):
+                        waiting_for_resources.append(entry)
+                        continue
+                    hold(task, 1)
+                    self._sink.started(task)
+                    running += 1
+                    started_with[key] = self._jobs or running
+                    threading.Thread(target=self._execute, args=(task,), daemon=True).start()
+                for entry in waiting_for_resources:
+                    heapq.heappush(ready, entry)
+
+                if self._cancelled.is_set():
+                    while ready:
+                        _, _, key = heapq.heappop(ready)
+                        if key not in outcomes:
+                            skipped = Outcome(Status.CANCELLED)
+                            self._sink.finished(by_key[key], skipped)
+                            resolve(key, skipped)
+                    if running == 0:
+                        for task in tasks:
+                            if task.key not in outcomes:
+                                skipped = Outcome(Status.CANCELLED)
+                                self._sink.finished(task, skipped)
+                                resolve(task.key, skipped)
+                        break
+
+                with self._done:
+                    # Use a timeout so KeyboardInterrupt is delivered promptly
+                    # on platforms where lock waits can't be interrupted.
+                    if not self._finished:
+                        self._done.wait(timeout=0.1)
+                    finished, self._finished = self._finished, []
+
+                for task, outcome in finished:
+                    running -= 1
+                    hold(task, -1)
+                    if (
+                        outcome.status == Status.FAILED
+                        and self._exhausted is not None
+                        and self._exhausted(outcome.value)
+                        and lower_jobs(task.key)
+                    ):
+                        self._sink.retrying(task, outcome, self._jobs)
+                        heapq.heappush(ready, (-task.priority, order[task.key], task.key))
+                        continue
+                    self._sink.finished(task, outcome)
+                    resolve(task.key, outcome)
+        except KeyboardInterrupt:
+            self.cancel()
+            with self._done:
+                while running > len(self._finished):
+                    self._done.wait(timeout=0.1)
+            raise
+
+        return outcomes
+
+    def _execute(self, task: Task) -> None:
+        try:
+            value = task.run(self._cancelled)
+            status = Status.SUCCEEDED if self._succeeded(value) else Status.FAILED
+            outcome = Outcome(status, value)
+        except Cancelled as e:
+            outcome = Outcome(Status.CANCELLED, e.value)
+        except BaseException as e:
+            outcome = Outcome(Status.FAILED, e)
+
+        with self._done:
+            self._finished.append((task, outcome))
+            self._done.notify_all()
+
+
+def _validate(tasks: List[Task], capacities: Mapping[str, int]) -> Dict[str, Task]:
+    by_key: Dict[str, Task] = {}
+    for task in tasks:
+        if task.key in by_key:
+            raise ValueError(f"duplicate task key: {task.key}")
+        by_key[task.key] = task
+        for resource, amount in task.resources.items():
+            if amount > capacities.get(resource, 1):
+                raise ValueError(f"task {task.key} needs {amount} of resource {resource}, which only has {capacities.get(resource, 1)}")
+
+    for task in tasks:
+        for dep in task.deps:
+            if dep not in by_key:
+                raise ValueError(f"task {task.key} depends on unknown task {dep}")
+
+    visiting = set()
+    visited = set()
+
+    def visit(key: str, path: List[str]) -> None:
+        if key in visited:
+            return
+        if key in visiting:
+            cycle = path[path.index(key):] + [key]
+            raise ValueError("dependency cycle: " + " -> ".join(cycle))
+        visiting.add(key)
+        for dep in by_key[key].deps:
+            visit(dep, path + [key])
+        visiting.remove(key)
+        visited.add(key)
+
+    for task in tasks:
+        visit(task.key, [])
+
+    return by_key
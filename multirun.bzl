@@ -7,44 +7,14 @@ in a single invocation.
 load("@bazel_skylib//lib:shell.bzl", "shell")
 load(
     "//internal:constants.bzl",
+    "BinaryArgsEnvInfo",
     "CommandInfo",
     "RUNFILES_PREFIX",
+    "binary_args_env_aspect",
     "rlocation_path",
     "update_attrs",
 )
 
-_BinaryArgsEnvInfo = provider(
-    fields = ["args", "env"],
-    doc = "The arguments and environment to use when running the binary",
-)
-
-def _binary_args_env_aspect_impl(target, ctx):
-    if _BinaryArgsEnvInfo in target:
-        return []
-
-    is_executable = target.files_to_run != None and target.files_to_run.executable != None
-    args = getattr(ctx.rule.attr, "args", [])
-    env = getattr(ctx.rule.attr, "env", {})
-
-    if is_executable and (args or env):
-        expansion_targets = getattr(ctx.rule.attr, "data", [])
-        if expansion_targets:
-            args = [
-                ctx.expand_location(arg, expansion_targets)
-                for arg in args
-            ]
-            env = {
-                name: ctx.expand_location(val, expansion_targets)
-                for name, val in env.items()
-            }
-        return [_BinaryArgsEnvInfo(args = args, env = env)]
-
-    return []
-
-_binary_args_env_aspect = aspect(
-    implementation = _binary_args_env_aspect_impl,
-)
-
 def _multirun_impl(ctx):
     instructions_file = ctx.actions.declare_file(ctx.label.name + ".json")
     runner_info = ctx.attr._runner[DefaultInfo]
@@ -59,55 +29,261 @@ def _multirun_impl(ctx):
         if default_runfiles != None:
             runfiles = runfiles.merge(default_runfiles)
 
-    commands = []
+    commands = {"commands": [], "post_commands": [], "pre_commands": []}
+    tags = {}
+    stdin_command = None
     tagged_commands = []
     runfiles_files = []
-    for command in ctx.attr.commands:
-        tagged_commands.append(struct(tag = str(command.label), command = command))
+    for attr_name in ["pre_commands", "commands", "post_commands"]:
+        for command in getattr(ctx.attr, attr_name):
+            tagged_commands.append(struct(tag = str(command.label), command = command, attr = attr_name))
 
     for tag_command in tagged_commands:
         command = tag_command.command
 
         default_info = command[DefaultInfo]
         if default_info.files_to_run == None:
-            fail("%s is not executable" % command.label, attr = "commands")
+            fail("%s is not executable" % command.label, attr = tag_command.attr)
         exe = default_info.files_to_run.executable
         if exe == None:
-            fail("%s does not have an executable file" % command.label, attr = "commands")
+            fail("%s does not have an executable file" % command.label, attr = tag_command.attr)
         runfiles_files.append(exe)
 
         args = []
         env = {}
-        if _BinaryArgsEnvInfo in command:
-            args = command[_BinaryArgsEnvInfo].args
-            env = command[_BinaryArgsEnvInfo].env
+        if BinaryArgsEnvInfo in command:
+            args = command[BinaryArgsEnvInfo].args
+            env = command[BinaryArgsEnvInfo].env
 
         default_runfiles = default_info.default_runfiles
         if default_runfiles != None:
             runfiles = runfiles.merge(default_runfiles)
 
+        tag = (ctx.attr.tag_template or "Running {label}").format(
+            label = tag_command.tag,
+            package = command.label.package,
+            name = command.label.name,
+        )
+        description = ""
+        repository = ""
+        stdin = False
+        background = False
+        expected_duration_seconds = 0
+        path_filters = []
+        priority = 0
+        ready_regex = ""
+        ready_timeout_seconds = 60
+        export_output_as = ""
+        resources = []
+        deps = []
+        stage = ""
+        retries = 0
+        retry_backoff = 1
+        locale = ""
+        timezone = ""
+        wait_for = []
+        materialize_runfiles = False
+        timeout_seconds = 0
+        grace_period_seconds = 10
+        inputs = []
+        run_as = ""
+        allow_failure = False
+        run_if = []
+        mutex = ""
+        group = ""
+        matrix = {}
         if CommandInfo in command:
-            tag = command[CommandInfo].description
-        else:
-            tag = "Running {}".format(tag_command.tag)
-
-        commands.append(struct(
+            info = command[CommandInfo]
+            description = info.description
+            if info.description:
+                tag = info.description
+            repository = info.repository
+            stdin = info.stdin
+            background = info.background
+            expected_duration_seconds = info.expected_duration_seconds
+            path_filters = info.path_filters
+            priority = info.priority
+            ready_regex = info.ready_regex
+            ready_timeout_seconds = info.ready_timeout_seconds
+            export_output_as = info.export_output_as
+            resources = info.resources
+            deps = info.deps
+            stage = info.stage
+            retries = info.retries
+            retry_backoff = info.retry_backoff
+            locale = info.locale
+            timezone = info.timezone
+            wait_for = info.wait_for
+            materialize_runfiles = info.materialize_runfiles
+            timeout_seconds = info.timeout_seconds
+            grace_period_seconds = info.grace_period_seconds
+            inputs = info.inputs
+            run_as = info.run_as
+            allow_failure = info.allow_failure
+            run_if = info.run_if
+            mutex = info.mutex
+            group = info.group
+            matrix = info.matrix
+
+        if stdin:
+            if stdin_command:
+                fail("%s and %s both read stdin, at most one command can set 'stdin'" % (stdin_command, command.label), attr = tag_command.attr)
+            stdin_command = command.label
+
+        if stage and tag_command.attr != "commands":
+            fail("%s is in stage '%s', only commands in 'commands' can have a stage" % (command.label, stage), attr = tag_command.attr)
+        if stage and stage not in ctx.attr.stages:
+            fail("%s is in stage '%s' which is not in 'stages'" % (command.label, stage), attr = tag_command.attr)
+
+        if repository and repository not in ctx.attr.repositories:
+            fail("%s runs in repository '%s' which is not in 'repositories'" % (command.label, repository), attr = tag_command.attr)
+
+        if tag in tags and ctx.attr.on_duplicate_tags == "fail":
+            fail("%s and %s both have the tag '%s', give them different descriptions or change 'on_duplicate_tags'" % (tags[tag], command.label, tag), attr = tag_command.attr)
+        tags[tag] = command.label
+
+        commands[tag_command.attr].append(struct(
             tag = tag,
+            description = description,
+            label = str(command.label),
             path = exe.short_path,
             args = args,
             env = env,
+            repository = repository,
+            stdin = stdin,
+            background = background,
+            deps = deps,
+            stage = stage,
+            retries = retries,
+            retry_backoff = retry_backoff,
+            expected_duration_seconds = expected_duration_seconds,
+            export_output_as = export_output_as,
+            path_filters = path_filters,
+            priority = priority,
+            ready_regex = ready_regex,
+            ready_timeout_seconds = ready_timeout_seconds,
+            resources = resources,
+            locale = locale,
+            timezone = timezone,
+            wait_for = wait_for,
+            materialize_runfiles = materialize_runfiles,
+            timeout_seconds = timeout_seconds,
+            grace_period_seconds = grace_period_seconds,
+            inputs = inputs,
+            run_as = run_as,
+            allow_failure = allow_failure,
+            run_if = run_if,
+            mutex = mutex,
+            group = group,
+            matrix = matrix,
         ))
 
-    if ctx.attr.jobs < 0:
-        fail("'jobs' attribute should be at least 0")
+    for attr_name, attr_commands in commands.items():
+        by_label = {command.label: command for command in attr_commands}
+        for command in attr_commands:
+            for dep in command.deps:
+                if dep not in by_label:
+                    fail("%s depends on %s, which isn't in '%s'" % (command.label, dep, attr_name), attr = attr_name)
+                if by_label[dep].background:
+                    fail("%s depends on %s, which runs in the background" % (command.label, dep), attr = attr_name)
+
+    if ctx.attr.jobs < -1:
+        fail("'jobs' attribute should be at least -1")
+    if ctx.attr.jobs_cpu_percent < 1:
+        fail("'jobs_cpu_percent' attribute should be at least 1")
+
+    if ctx.attr.budget_percent < 100:
+        fail("'budget_percent' attribute should be at least 100")
+    if ctx.attr.max_jobs < 0:
+        fail("'max_jobs' attribute should be at least 0")
+    if ctx.attr.output_slice_seconds < 0:
+        fail("'output_slice_seconds' attribute should be at least 0")
+    if ctx.attr.stagger_ms < 0:
+        fail("'stagger_ms' attribute should be at least 0")
+    if ctx.attr.deadline_seconds < 0:
+        fail("'deadline_seconds' attribute should be at least 0")
+    if ctx.attr.repeat_seconds < 0:
+        fail("'repeat_seconds' attribute should be at least 0")
+    if ctx.attr.pipeline and ctx.attr.buffer_output:
+        fail("pipelines can't buffer output, the last command writes straight to the terminal", attr = "buffer_output")
+    if ctx.attr.prefix_output and ctx.attr.buffer_output:
+        fail("output can either be buffered or prefixed, not both", attr = "prefix_output")
+    if ctx.attr.prefix_output and ctx.attr.pipeline:
+        fail("commands in a pipeline write to each other, their output can't be prefixed", attr = "prefix_output")
+    if ctx.attr.timestamps != "none" and ctx.attr.buffer_output:
+        fail("buffered output is printed after it was written, it can't be timestamped", attr = "timestamps")
+    if ctx.attr.timestamps != "none" and ctx.attr.pipeline:
+        fail("commands in a pipeline write to each other, their output can't be timestamped", attr = "timestamps")
+    if ctx.attr.log_dir and ctx.attr.pipeline:
+        fail("commands in a pipeline write to each other, their output can't be logged", attr = "log_dir")
+    if ctx.attr.pipeline and ctx.attr.stages:
+        fail("commands in a pipeline can't be in stages", attr = "stages")
+    if ctx.attr.health_port < 0 or ctx.attr.health_port > 65535:
+        fail("'health_port' attribute should be a port number between 0 and 65535")
+    resource_capacities = {}
+    for resource, capacity in ctx.attr.resource_capacities.items():
+        if not capacity.isdigit() or int(capacity) < 1:
+            fail("resource '%s' should have a capacity of at least 1, got '%s'" % (resource, capacity), attr = "resource_capacities")
+        resource_capacities[resource] = int(capacity)
+    group_jobs = {}
+    for group, group_limit in ctx.attr.group_jobs.items():
+        if not group_limit.isdigit() or int(group_limit) < 1:
+            fail("group '%s' should have jobs of at least 1, got '%s'" % (group, group_limit), attr = "group_jobs")
+        group_jobs[group] = int(group_limit)
+    for index, stage in enumerate(ctx.attr.stages):
+        if stage in ctx.attr.stages[:index]:
+            fail("stage '%s' is listed more than once" % stage, attr = "stages")
 
     jobs = ctx.attr.jobs
     instructions = struct(
-        commands = commands,
+        version = 1,
+        pre_commands = commands["pre_commands"],
+        commands = commands["commands"],
+        post_commands = commands["post_commands"],
+        env = {
+            name: ctx.expand_location(value, targets = ctx.attr.data)
+            for name, value in ctx.attr.environment.items()
+        },
         jobs = jobs,
+        jobs_cpu_percent = ctx.attr.jobs_cpu_percent,
+        max_jobs = ctx.attr.max_jobs,
+        adaptive_jobs = ctx.attr.adaptive_jobs,
+        deadline_seconds = ctx.attr.deadline_seconds,
+        repeat_seconds = ctx.attr.repeat_seconds,
+        watch = ctx.attr.watch,
+        health_port = ctx.attr.health_port,
+        normalize_paths = ctx.attr.normalize_paths,
+        output_slice_seconds = ctx.attr.output_slice_seconds,
+        stagger_ms = ctx.attr.stagger_ms,
         print_command = ctx.attr.print_command,
+        print_command_details = ctx.attr.print_command_details,
         keep_going = ctx.attr.keep_going,
+        stop_on_error = ctx.attr.stop_on_error,
+        shuffle = ctx.attr.shuffle,
+        pipeline = ctx.attr.pipeline,
+        prefix_output = ctx.attr.prefix_output,
+        timestamps = ctx.attr.timestamps,
+        log_dir = ctx.attr.log_dir,
+        output_format = ctx.attr.output_format,
+        locale = ctx.attr.locale,
+        timezone = ctx.attr.timezone,
         buffer_output = ctx.attr.buffer_output,
+        changed_files = ctx.attr.changed_files,
+        env_file = ctx.attr.env_file,
+        exit_code_policy = ctx.attr.exit_code_policy,
+        fragments = [rlocation_path(ctx, fragment) for fragment in ctx.files.fragments],
+        on_duplicate_tags = ctx.attr.on_duplicate_tags,
+        on_empty = ctx.attr.on_empty,
+        over_budget = ctx.attr.over_budget,
+        budget_percent = ctx.attr.budget_percent,
+        preflight = ctx.attr.preflight,
+        repositories = ctx.attr.repositories,
+        resource_capacities = resource_capacities,
+        group_jobs = group_jobs,
+        stages = ctx.attr.stages,
+        system_log = ctx.attr.system_log,
+        label = str(ctx.label),
+        tag_template = ctx.attr.tag_template,
         workspace_name = ctx.workspace_name,
     )
     ctx.actions.write(
@@ -115,11 +291,15 @@ def _multirun_impl(ctx):
         content = json.encode(instructions),
     )
 
+    instructions_path = shell.quote(rlocation_path(ctx, instructions_file))
     script = """\
-multirun_script="$(rlocation {})"
-instructions="$(rlocation {})"
+multirun_script="$(rlocation {runner})"
+# The runner looks elsewhere if this lookup fails.
+instructions="$(rlocation {instructions})" || true
+export MULTIRUN_INSTRUCTIONS_RLOCATION={instructions}
+export MULTIRUN_LAUNCHER="$0"
 exec "$multirun_script" "$instructions" "$@"
-""".format(shell.quote(rlocation_path(ctx, runner_exe)), shell.quote(rlocation_path(ctx, instructions_file)))
+""".format(runner = shell.quote(rlocation_path(ctx, runner_exe)), instructions = instructions_path)
     out_file = ctx.actions.declare_file(ctx.label.name + ".bash")
     ctx.actions.write(
         output = out_file,
@@ -129,7 +309,7 @@ exec "$multirun_script" "$instructions" "$@"
     return [
         DefaultInfo(
             files = depset([out_file]),
-            runfiles = runfiles.merge(ctx.runfiles(files = runfiles_files + ctx.files.data)),
+            runfiles = runfiles.merge(ctx.runfiles(files = runfiles_files + ctx.files.data + ctx.files.fragments)),
             executable = out_file,
         ),
     ]
@@ -148,7 +328,7 @@ def multirun_with_transition(cfg, allowlist = None):
         "commands": attr.label_list(
             mandatory = False,
             allow_files = True,
-            aspects = [_binary_args_env_aspect],
+            aspects = [binary_args_env_aspect],
             doc = "Targets to run",
             cfg = cfg,
         ),
@@ -156,22 +336,174 @@ def multirun_with_transition(cfg, allowlist = None):
             doc = "The list of files needed by the commands at runtime. See general comments about `data` at https://docs.bazel.build/versions/master/be/common-definitions.html#common-attributes",
             allow_files = True,
         ),
+        "fragments": attr.label_list(
+            allow_files = [".json"],
+            doc = "Instructions files generated elsewhere whose `commands`, `pre_commands`, `post_commands`, `env`, and `repositories` are added to this multirun's, after its own. Commands in fragments give their executables' paths relative to the workspace, which must be in `data`. Fragments setting the same environment variable or repository to different values are an error.",
+        ),
+        "group_jobs": attr.string_dict(
+            doc = "How many commands of each concurrency group can run at once, for example `{\"bazel\": \"2\", \"python\": \"16\"}`, see the commands' `group`. Commands of groups that aren't listed are only limited by `jobs`.",
+        ),
         "jobs": attr.int(
             default = 1,
-            doc = "The expected concurrency of targets to be executed. Default is set to 1 which means sequential execution. Setting to 0 means that there is no limit concurrency.",
+            doc = "How many commands run at once. Default is set to 1 which means sequential execution. Setting to 0 means that there is no limit concurrency, -1 runs one per CPU multirun can use, scaled by `jobs_cpu_percent`, and any other number runs that many at a time, starting the next command as soon as one finishes. `MULTIRUN_JOBS` overrides this for a single run.",
+        ),
+        "jobs_cpu_percent": attr.int(
+            default = 100,
+            doc = "How many commands run at once when `jobs` is -1, as a percentage of the CPUs multirun can use, for example 50 for half of them or 200 for two per CPU. At least 1 command runs.",
         ),
         "print_command": attr.bool(
             default = True,
             doc = "Print what command is being run before running it.",
         ),
+        "print_command_details": attr.bool(
+            default = False,
+            doc = "Print each command's resolved path, full argv, working directory, and the environment variables that differ from multirun's own along with its tag, so a failing command can be reproduced by hand. Only when `print_command` is set.",
+        ),
+        "health_port": attr.int(
+            default = 0,
+            doc = "Serve health checks over HTTP on this port, on every interface, for load balancers and container probes. `/healthz` answers 200 while no background command exited, and `/readyz` answers 200 while it's healthy, once the pre commands succeeded and until the post commands start. Otherwise they answer 503. `MULTIRUN_HEALTH_PORT` overrides this for a single run. 0 doesn't serve them.",
+        ),
         "keep_going": attr.bool(
             default = False,
-            doc = "Keep going after a command fails. Only for sequential execution.",
+            doc = "Keep going after a command fails. Only for sequential execution, parallel commands keep going unless `stop_on_error` is set.",
+        ),
+        "locale": attr.string(
+            default = "C.UTF-8",
+            doc = "The locale to run commands in, set as `LANG` and `LC_ALL`, so checks that compare output and golden tests don't depend on the machine. An empty string keeps the machine's locale. Takes precedence over `environment`, commands can override it with their own `locale`.",
+        ),
+        "adaptive_jobs": attr.bool(
+            default = False,
+            doc = "When a parallel command fails in a way that looks like the machine ran out of memory, lower `jobs` to half of what it was when the command started and run it again, until commands run one at a time. Commands look like they ran out of memory when they're killed with `SIGKILL`, exit with code 137, or, with `buffer_output`, print `ENOMEM` or `Cannot allocate memory`. Useful for memory-heavy commands on small CI machines.",
+        ),
+        "max_jobs": attr.int(
+            default = 0,
+            doc = "The most commands that run at once, whatever `jobs`, `MULTIRUN_JOBS` or `--jobs` say. Useful when `MULTIRUN_JOBS` is set for a machine, but some multiruns can't use that many. 0 means no limit.",
+        ),
+        "budget_percent": attr.int(
+            default = 200,
+            doc = "How much of its `expected_duration_seconds` a command can take, as a percentage, before it's over budget.",
         ),
         "buffer_output": attr.bool(
             default = False,
             doc = "Buffer the output of the commands and print it after each command has finished. Only for parallel execution.",
         ),
+        "changed_files": attr.string(
+            doc = "Only run on the files git reports as changed, useful for pre-commit and pre-push hooks. `staged` uses the staged files, a git ref such as `origin/main` uses the files committed since it. Commands with `path_filters` are skipped unless a changed file matches them. Commands get the files in `MULTIRUN_CHANGED_FILES`, one per line, and in a file whose path is in `MULTIRUN_CHANGED_FILES_LIST`. `MULTIRUN_CHANGED` overrides this for a single run, `all` runs everything.",
+        ),
+        "deadline_seconds": attr.int(
+            default = 0,
+            doc = "How many seconds the whole run can take. When it takes longer the pre commands and commands that are still running are stopped, the ones that didn't start are cancelled, and the multirun exits with 124, so CI jobs can't hang forever on a stuck command. Post commands still run. `MULTIRUN_DEADLINE` overrides this for a single run. 0 means no deadline.",
+        ),
+        "environment": attr.string_dict(
+            doc = "Dictionary of environment variables set for every command. Subject to $(location) expansion. Commands' own environment variables take precedence over these, which take precedence over the environment multirun was run with.",
+        ),
+        "env_file": attr.string(
+            doc = "A project env file of `NAME=VALUE` lines, relative to the workspace root, for example `.multirun.env`. Its variables are set for every command and take precedence over `environment` and the commands' own environment variables, so local overrides like API endpoints or feature flags don't need `BUILD` file changes. It's ignored if it doesn't exist. `MULTIRUN_ENV_FILE` overrides this for a single run.",
+        ),
+        "exit_code_policy": attr.string(
+            default = "any",
+            values = ["any", "first_failure", "highest", "count"],
+            doc = "How the exit codes of failed commands are combined into the multirun's exit code. `any` exits with 1 if any command failed, or with the exit code of the failed command when commands run one at a time and only one failed, `first_failure` uses the exit code of the first command to fail, `highest` uses the highest exit code, and `count` uses the number of failed commands (capped at 123). Commands killed by signal N count as exit code 128 + N. If a command can't be started the run stops and exits with 127 if it was not found, or 126 otherwise. Errors in multirun itself, such as invalid instructions or missing runfiles, exit with 125, and runs that take longer than their `deadline_seconds` exit with 124.",
+        ),
+        "log_dir": attr.string(
+            doc = "A directory to write each command's output to besides the terminal, as `<tag>.log` with the characters of the tag that aren't safe in file names replaced, for example `tests_lint.log` for `//tests:lint`, so CI can archive the output of every command. Relative paths are in `TEST_UNDECLARED_OUTPUTS_DIR` in tests, and in the directory `bazel run` was run in otherwise. Unbuffered output is forwarded line by line for this, with stderr merged into stdout, so commands don't write to the terminal directly. Each run starts new logs, and retries add to them. Not together with `pipeline`.",
+        ),
+        "normalize_paths": attr.bool(
+            default = False,
+            doc = "Rewrite absolute paths into the runfiles, the execroot, the output base, and the workspace in buffered output to workspace relative paths with forward slashes, so logs from different machines and platforms can be compared. Only for buffered output, see `buffer_output`.",
+        ),
+        "on_duplicate_tags": attr.string(
+            default = "warn",
+            values = ["number", "warn", "fail"],
+            doc = "What to do when commands have the same tag, the description or label printed for them. `number` numbers them in the output and results, for example `lint #1` and `lint #2`, `warn` also prints a warning, and `fail` fails the build.",
+        ),
+        "on_empty": attr.string(
+            default = "warn",
+            values = ["succeed", "warn", "fail"],
+            doc = "What to do when there are no commands to run. `succeed` exits successfully, `warn` also prints a warning, and `fail` exits with 125 like other multirun configuration errors.",
+        ),
+        "output_format": attr.string(
+            default = "auto",
+            values = ["auto", "plain", "github", "buildkite", "teamcity"],
+            doc = "How the output of each command is marked up for CI logs that render it natively. `github` puts it in a collapsible group and annotates failed commands, `buildkite` puts it in a collapsible section and expands the sections of failed commands, and `teamcity` puts it in a block and reports failed commands as build problems. `auto` picks the CI system from `GITHUB_ACTIONS`, `BUILDKITE`, or `TEAMCITY_VERSION`, and `plain` only prints the tags. Only output that's in one piece is marked up, when commands run one at a time or with `buffer_output`.",
+        ),
+        "output_slice_seconds": attr.int(
+            default = 0,
+            doc = "With `buffer_output`, print the lines each command wrote so far every this many seconds while it runs, after its tag followed by `(continued)` once some were printed, instead of only when it finishes. A middle ground between interleaved and grouped output for long running parallel commands. The rest of a command's output is still printed in the order the commands were given. 0 only prints output when commands finish.",
+        ),
+        "over_budget": attr.string(
+            default = "warn",
+            values = ["ignore", "warn", "fail"],
+            doc = "What to do when a command takes longer than its budget, see `budget_percent` and the command's `expected_duration_seconds`. `warn` prints a warning, `fail` fails the command even though it succeeded.",
+        ),
+        "pipeline": attr.bool(
+            default = False,
+            doc = "Connect the stdout of each of `commands` to the stdin of the next, like a shell pipeline. They all start at once whatever `jobs` is, the first reads the multirun's stdin, the last writes to its stdout, and errors reach the terminal. The multirun fails if any of them fails, like with `set -o pipefail`. Commands in a pipeline can't have `deps`, a `stage`, `retries`, `resources`, a `mutex`, a `group`, or `export_output_as`. `pre_commands` and `post_commands` run before and after as usual.",
+        ),
+        "post_commands": attr.label_list(
+            allow_files = True,
+            aspects = [binary_args_env_aspect],
+            doc = "Targets to run one at a time after `commands`, whether or not the earlier commands succeeded or the run was interrupted. Useful for cleaning up.",
+            cfg = cfg,
+        ),
+        "pre_commands": attr.label_list(
+            allow_files = True,
+            aspects = [binary_args_env_aspect],
+            doc = "Targets to run one at a time before `commands`. If one of them fails, `commands` are skipped.",
+            cfg = cfg,
+        ),
+        "prefix_output": attr.bool(
+            default = False,
+            doc = "Print each line the commands write as soon as it's complete, prefixed with the command's tag like `[//:lint] `, in a color of its own on terminals, so the output of commands running at once can be told apart while they run. Their stderr is merged into their stdout for this, except for commands with `export_output_as` whose stdout isn't printed. Only for parallel execution, and not together with `buffer_output`.",
+        ),
+        "preflight": attr.bool(
+            default = True,
+            doc = "Before running anything, check that every command's interpreter and working directory exist, and report all problems at once.",
+        ),
+        "repeat_seconds": attr.int(
+            default = 0,
+            doc = "Run the commands again this many seconds after each run finishes, until the multirun is interrupted, printing a divider with the run's number and time before each. A simple scheduler for local development tasks. Interrupting it while it waits exits with the last run's exit code. Ignored under ibazel, which reruns the commands after rebuilds instead. `MULTIRUN_REPEAT` overrides this for a single run. 0 runs the commands once.",
+        ),
+        "repositories": attr.string_dict(
+            doc = "Sibling repository checkouts that commands can run in, mapping a name to a directory relative to the workspace root, for example `{\"other\": \"../other\"}`. A command with a matching `repository` runs with that directory as its working directory and `BUILD_WORKSPACE_DIRECTORY`, and with `MULTIRUN_REPOSITORY` set to the name.",
+        ),
+        "resource_capacities": attr.string_dict(
+            doc = "How many commands can use each shared resource at once, for example `{\"license-server\": \"2\"}`, see the commands' `resources`. Resources that aren't listed can be used by one command at a time.",
+        ),
+        "stages": attr.string_list(
+            doc = "Names of stages that run one after the other, for example `[\"migrate\", \"services\", \"smoke\"]`. Commands in `commands` pick theirs with their `stage`, and start once every command of the earlier stages succeeded. Commands of the same stage run alongside each other as `jobs` allows, and commands without a stage don't wait for any.",
+        ),
+        "shuffle": attr.bool(
+            default = False,
+            doc = "Run `commands` in a random order, to find commands that secretly depend on running after others. `deps` and `stages` are still respected. The seed is printed, `MULTIRUN_SHUFFLE_SEED` runs them in the same order again. `MULTIRUN_SHUFFLE` overrides this for a single run.",
+        ),
+        "stagger_ms": attr.int(
+            default = 0,
+            doc = "How many milliseconds to wait between starting commands that run in parallel, so they don't all hit a shared service like a license server at the same moment. Commands start in the order the scheduler picks them, and retries aren't delayed. Only applies to `commands` when `jobs` isn't 1. 0 starts them right away.",
+        ),
+        "stop_on_error": attr.bool(
+            default = False,
+            doc = "When running in parallel, stop the other commands as soon as one fails instead of letting them run to completion, for faster feedback in CI. Commands that didn't start yet are cancelled. `MULTIRUN_KEEP_GOING=1` turns this off for a single run.",
+        ),
+        "system_log": attr.bool(
+            default = False,
+            doc = "Also log when the run starts and finishes, every command that fails, and problems that don't stop the run, to syslog on Unix or the Application Event Log on Windows, for supervisors of long running multiruns.",
+        ),
+        "tag_template": attr.string(
+            doc = "Template for the tags of commands without a description. It can use `{label}`, `{package}` and `{name}` from the command's label, for example `{package}:{name}`. The default is `Running {label}`.",
+        ),
+        "timestamps": attr.string(
+            default = "none",
+            values = ["none", "clock", "elapsed"],
+            doc = "Print each line the commands write as soon as it's complete, after the time it was written, to correlate the output of commands running at once. `clock` is the time of day like `14:03:30.123`, `elapsed` the time since the multirun started like `+12.345s`. Their stderr is merged into their stdout for this, so commands don't write to the terminal directly. Works with `prefix_output`, the timestamp comes first. Not together with `buffer_output` or `pipeline`.",
+        ),
+        "timezone": attr.string(
+            default = "UTC",
+            doc = "The timezone to run commands in, set as `TZ`. An empty string keeps the machine's timezone. Takes precedence over `environment`, commands can override it with their own `timezone`.",
+        ),
+        "watch": attr.string_list(
+            doc = "Glob patterns, relative to the workspace root, of files to watch, for example `[\"src/*\"]`. `*` also matches `/`. After the commands ran, or while they run, a change to a watched file or a command's `inputs` runs them again, once the files stopped changing for a moment. Only the commands whose `inputs` changed, the commands without `inputs`, and the ones the change stopped run again, pre and post commands always do. Turns long-running commands like dev servers into hot-reloading ones. `MULTIRUN_WATCH` overrides whether to watch for a single run. Ignored under ibazel, which watches the sources itself.",
+        ),
         "_bash_runfiles": attr.label(
             default = Label("@bazel_tools//tools/bash/runfiles"),
         ),
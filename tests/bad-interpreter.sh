@@ -0,0 +1 @@
+#!/no/such/interpreter
@@ -0,0 +1,8 @@
+#!/bin/bash
+
+set -euo pipefail
+
+# Prints the status line multirun's health checks answer $2 on port $1 with.
+exec 3<> "/dev/tcp/127.0.0.1/$1"
+printf 'GET %s HTTP/1.0\r\n\r\n' "$2" >&3
+head -n 1 <&3 | tr -d '\r'
@@ -0,0 +1,8 @@
+#!/bin/bash
+
+set -euo pipefail
+
+if [[ ! -f "$TEST_TMPDIR/deps.marker" ]]; then
+  echo "Expected the command's dependency to have finished first" >&2
+  exit 1
+fi
@@ -0,0 +1,11 @@
+#!/bin/bash
+
+set -euo pipefail
+
+# Prints how many copies of itself are running at once.
+running="$TEST_TMPDIR/running"
+mkdir -p "$running"
+touch "$running/$$"
+sleep 0.5
+ls "$running" | wc -l | tr -d ' '
+rm "$running/$$"
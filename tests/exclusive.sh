@@ -0,0 +1,9 @@
+#!/bin/bash
+
+set -euo pipefail
+
+# Fails if another command holds the lock.
+lock="$TEST_TMPDIR/exclusive.lock"
+mkdir "$lock"
+sleep 0.5
+rmdir "$lock"
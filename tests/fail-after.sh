@@ -0,0 +1,7 @@
+#!/bin/bash
+
+set -euo pipefail
+
+# Fails once the commands next to it have had time to start.
+sleep "$1"
+exit 1
@@ -0,0 +1,12 @@
+#!/bin/bash
+
+set -euo pipefail
+
+# Fails the first two times it runs.
+attempts="$TEST_TMPDIR/flaky.attempts"
+echo >> "$attempts"
+if (( $(wc -l < "$attempts") < 3 )); then
+  echo "flaky failure" >&2
+  exit 1
+fi
+echo "flaky success"
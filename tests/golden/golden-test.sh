@@ -0,0 +1,98 @@
+#!/bin/bash
+
+set -euo pipefail
+
+# --- begin runfiles.bash initialization v2 ---
+# Copy-pasted from the Bazel Bash runfiles library v2.
+set -uo pipefail; set +e; f=bazel_tools/tools/bash/runfiles/runfiles.bash
+# shellcheck disable=SC1090
+source "${RUNFILES_DIR:-/dev/null}/$f" 2>/dev/null || \
+  source "$(grep -sm1 "^$f " "${RUNFILES_MANIFEST_FILE:-/dev/null}" | cut -f2- -d' ')" 2>/dev/null || \
+  source "$0.runfiles/$f" 2>/dev/null || \
+  source "$(grep -sm1 "^$f " "$0.runfiles_manifest" | cut -f2- -d' ')" 2>/dev/null || \
+  source "$(grep -sm1 "^$f " "$0.exe.runfiles_manifest" | cut -f2- -d' ')" 2>/dev/null || \
+  { echo>&2 "ERROR: cannot find $f"; exit 1; }; f=; set -e
+# --- end runfiles.bash initialization v2 ---
+
+export PATH=/usr/bin:/bin
+
+# Signals and process groups work differently enough on Windows that those
+# cases are only checked elsewhere.
+windows=false
+if [[ "$OSTYPE" == msys* || "$OSTYPE" == cygwin* ]]; then
+  windows=true
+fi
+
+failed=false
+
+# Runs the multirun and compares its exit code, stdout, and stderr with the
+# expected ones, printing a diff of any differences.
+golden() {
+  local name=$1
+  local expected_exit_code=$2
+  local script
+  script=$(rlocation "rules_multirun/tests/golden/$name.bash")
+
+  local exit_code=0
+  "$script" > "$TEST_TMPDIR/$name.stdout" 2> "$TEST_TMPDIR/$name.stderr" || exit_code=$?
+  if [[ "$exit_code" != "$expected_exit_code" ]]; then
+    echo "$name: expected exit code $expected_exit_code, got $exit_code"
+    failed=true
+  fi
+
+  local stream
+  for stream in stdout stderr; do
+    # Python writes CRLF line endings on Windows, and releases have their
+    # own version.
+    tr -d '\r' < "$TEST_TMPDIR/$name.$stream" \
+      | sed 's/(multirun [^)]*)/(multirun VERSION)/' > "$TEST_TMPDIR/$name.$stream.actual"
+    if ! diff -u "$(rlocation "rules_multirun/tests/golden/$name.$stream")" "$TEST_TMPDIR/$name.$stream.actual"; then
+      echo "$name: unexpected $stream"
+      failed=true
+    fi
+  done
+}
+
+# Serial runs with a single failure exit with the command's exit code.
+golden golden_serial 3
+golden golden_serial_keep_going 3
+golden golden_serial_failures 1
+golden golden_parallel_buffered 1
+golden golden_bounded 1
+if [[ "$windows" == false ]]; then
+  golden golden_signal 143
+  golden golden_highest 143
+fi
+
+script=$(rlocation rules_multirun/tests/golden/huge_output_parallel.bash)
+line_count=$("$script" | wc -l)
+if [[ "$line_count" -ne 100001 ]]; then
+  echo "huge_output_parallel: expected 100001 lines, got $line_count"
+  failed=true
+fi
+
+if [[ "$windows" == false ]]; then
+  script=$(rlocation rules_multirun/tests/golden/cancel_parallel.bash)
+  # Without job control background jobs ignore SIGINT.
+  set -m
+  "$script" > /dev/null 2>&1 &
+  set +m
+  pid=$!
+  sleep 2
+  start=$SECONDS
+  kill -INT "$pid"
+  exit_code=0
+  wait "$pid" || exit_code=$?
+  if [[ "$exit_code" != 1 ]]; then
+    echo "cancel_parallel: expected exit code 1 after SIGINT, got $exit_code"
+    failed=true
+  fi
+  if (( SECONDS - start > 10 )); then
+    echo "cancel_parallel: took $((SECONDS - start))s to stop after SIGINT"
+    failed=true
+  fi
+fi
+
+if [[ "$failed" == true ]]; then
+  exit 1
+fi
@@ -0,0 +1,8 @@
+#!/bin/bash
+
+set -euo pipefail
+
+# More than any pipe buffer, to catch deadlocks reading buffered output.
+for i in $(seq 1 100000); do
+  echo "line $i"
+done
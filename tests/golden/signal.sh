@@ -0,0 +1,6 @@
+#!/bin/bash
+
+set -euo pipefail
+
+echo "about to be killed"
+kill -TERM $$
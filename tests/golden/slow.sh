@@ -0,0 +1,6 @@
+#!/bin/bash
+
+set -euo pipefail
+
+sleep "$1"
+echo "slow finished"
@@ -0,0 +1,15 @@
+#!/bin/bash
+
+set -euo pipefail
+
+# Pretends the machine only has enough memory for one of these at a time.
+running="$TEST_TMPDIR/memory_hungry"
+mkdir -p "$running"
+touch "$running/$$"
+sleep 0.5
+count=$(ls "$running" | wc -l)
+rm "$running/$$"
+if (( count > 1 )); then
+  echo "Cannot allocate memory"
+  exit 1
+fi
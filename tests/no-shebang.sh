@@ -0,0 +1,2 @@
+# Without a shebang the system can't tell how to run this.
+echo "no shebang"
@@ -0,0 +1,4 @@
+#!/bin/bash
+
+# Checked in without the executable bit, multirun has to refuse to run it.
+echo "not executable"
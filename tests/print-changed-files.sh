@@ -0,0 +1,5 @@
+#!/bin/bash
+
+set -euo pipefail
+
+cat "$MULTIRUN_CHANGED_FILES_LIST"
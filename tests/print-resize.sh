@@ -0,0 +1,10 @@
+#!/bin/bash
+
+set -euo pipefail
+
+# Says when its terminal was resized.
+trap 'kill "$sleep_pid" 2> /dev/null || true; echo resized; exit 0' WINCH
+sleep 30 &
+sleep_pid=$!
+touch "$TEST_TMPDIR/resize.ready"
+wait
@@ -0,0 +1,8 @@
+#!/bin/bash
+
+set -euo pipefail
+
+# Prints a line, then another one after a while.
+echo "first"
+sleep 2
+echo "second"
@@ -0,0 +1,9 @@
+#!/bin/bash
+
+set -euo pipefail
+
+if read -r line; then
+  echo "read '$line'"
+else
+  echo "no input"
+fi
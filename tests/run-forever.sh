@@ -0,0 +1,5 @@
+#!/bin/bash
+
+set -euo pipefail
+
+sleep 300
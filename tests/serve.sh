@@ -0,0 +1,10 @@
+#!/bin/bash
+
+set -euo pipefail
+
+# Takes a while to get ready so commands that don't wait for it would miss
+# the marker.
+sleep 0.5
+touch "$TEST_TMPDIR/deps.marker"
+echo "listening on 8080"
+sleep 300
@@ -0,0 +1,8 @@
+#!/bin/bash
+
+set -euo pipefail
+
+# Starts a process that outlives this script unless it's stopped with it.
+sleep 300 &
+echo "$!" >> "$CHILD_PIDS"
+wait
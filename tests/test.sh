@@ -17,6 +17,39 @@ source "${RUNFILES_DIR:-/dev/null}/$f" 2>/dev/null || \
 # PATH varies when running vs testing, this makes it more like running to validate the actual behavior. Specifically '.' is included for tests but not runs
 export PATH=/usr/bin:/bin
 
+# Prints instructions for running the runner directly, with the commands
+# from stdin. Arguments like jobs=0 replace the default settings or add
+# others.
+instructions_json() {
+  local -A settings=([jobs]=1 [print_command]=false [keep_going]=false [buffer_output]=false)
+  local setting json='{"workspace_name": "rules_multirun"'
+  for setting in "$@"; do
+    settings[${setting%%=*}]=${setting#*=}
+  done
+  for setting in "${!settings[@]}"; do
+    json+=", \"$setting\": ${settings[$setting]}"
+  done
+  echo "$json, \"commands\": [$(cat)]}"
+}
+
+# Fails the test with the message if any of the processes is still running
+# after a few seconds, killed processes linger until they're reaped.
+expect_stopped() {
+  local message=$1 pid
+  shift
+  for pid in "$@"; do
+    for _ in $(seq 50); do
+      kill -0 "$pid" 2> /dev/null || break
+      sleep 0.1
+    done
+    if kill -0 "$pid" 2> /dev/null; then
+      kill "$pid"
+      echo "$message"
+      exit 1
+    fi
+  done
+}
+
 script=$(rlocation rules_multirun/tests/hello.bash)
 output=$($script)
 if [[ "$output" != "hello" ]]; then
@@ -38,6 +71,16 @@ $script
 script=$(rlocation rules_multirun/tests/multirun_binary_args_location.bash)
 $script
 
+for command in validate_binary_args_cmd validate_binary_env_cmd validate_binary_args_location_cmd validate_binary_env_overridden_cmd; do
+  script=$(rlocation "rules_multirun/tests/$command.bash")
+  $script
+done
+script=$(rlocation rules_multirun/tests/multirun_command_binary_args_env.bash)
+$script
+
+script=$(rlocation rules_multirun/tests/multirun_data_runfiles.bash)
+$script
+
 script="$(rlocation rules_multirun/tests/multirun_parallel.bash)"
 parallel_output="$($script)"
 if [[ -n "$parallel_output" ]]; then
@@ -52,6 +95,13 @@ if [[ -n "$parallel_output" ]]; then
   exit 1
 fi
 
+script="$(rlocation rules_multirun/tests/multirun_parallel_more_jobs_than_commands.bash)"
+parallel_output="$($script)"
+if [[ "$parallel_output" != "hello" ]]; then
+  echo "Expected untagged output, got '$parallel_output'"
+  exit 1
+fi
+
 script="$(rlocation rules_multirun/tests/multirun_parallel_with_output.bash)"
 parallel_output=$($script | sed 's=@[^/]*/=@/=g')
 if [[ "$parallel_output" != "Running @//tests:echo_hello
@@ -62,6 +112,13 @@ hello2" ]]; then
   exit 1
 fi
 
+script="$(rlocation rules_multirun/tests/multirun_invalid_utf8.bash)"
+if ! invalid_utf8_output=$($script 2>&1) || [[ "$invalid_utf8_output" != "bad "*" byte
+hello2" ]]; then
+  echo "Expected output that isn't valid UTF-8 to be printed, got '$invalid_utf8_output'"
+  exit 1
+fi
+
 script=$(rlocation rules_multirun/tests/multirun_serial.bash)
 serial_output=$($script | sed 's=@[^/]*/=@/=g')
 if [[ "$serial_output" != "Running @//tests:validate_args_cmd
@@ -84,6 +141,44 @@ hello" ]]; then
   exit 1
 fi
 
+# In GitHub Actions each command's output is a group, and failures are
+# annotated.
+github_output=$(GITHUB_ACTIONS=true $script 2> /dev/null | sed 's=@[^/]*/=@/=g') || true
+if [[ "$github_output" != "::group::Running @//tests:echo_and_fail
+hello and fail
+::endgroup::
+::group::Running @//tests:echo_hello
+hello
+::endgroup::
+::error title=Running @//tests%3Aecho_and_fail::Running @//tests:echo_and_fail failed with exit code 1" ]]; then
+  echo "Expected grouped output and an annotation, got '$github_output'"
+  exit 1
+fi
+
+# Buildkite expands the sections of failed commands.
+buildkite_output=$(BUILDKITE=true $script 2> /dev/null | sed 's=@[^/]*/=@/=g') || true
+if [[ "$buildkite_output" != "--- Running @//tests:echo_and_fail
+hello and fail
+^^^ +++
+--- Running @//tests:echo_hello
+hello" ]]; then
+  echo "Expected a section for each command, got '$buildkite_output'"
+  exit 1
+fi
+
+# TeamCity gets blocks, and build problems for failures.
+teamcity_output=$(TEAMCITY_VERSION=2024.1 $script 2> /dev/null | sed 's=@[^/]*/=@/=g') || true
+if [[ "$teamcity_output" != "##teamcity[blockOpened name='Running @//tests:echo_and_fail']
+hello and fail
+##teamcity[blockClosed name='Running @//tests:echo_and_fail']
+##teamcity[blockOpened name='Running @//tests:echo_hello']
+hello
+##teamcity[blockClosed name='Running @//tests:echo_hello']
+##teamcity[buildProblem description='Running @//tests:echo_and_fail failed with exit code 1']" ]]; then
+  echo "Expected a block for each command and a build problem, got '$teamcity_output'"
+  exit 1
+fi
+
 script=$(rlocation rules_multirun/tests/multirun_serial_description.bash)
 serial_output=$($script | sed 's=@[^/]*/=@/=g')
 if [[ "$serial_output" != "some custom string
@@ -113,3 +208,1318 @@ if [[ "$root_output" != "hello" ]]; then
   echo "Expected 'hello' from root, got '$root_output'"
   exit 1
 fi
+
+workspace="$TEST_TMPDIR/main"
+mkdir -p "$workspace" "$TEST_TMPDIR/other"
+script=$(rlocation rules_multirun/tests/multirun_repository.bash)
+BUILD_WORKSPACE_DIRECTORY="$workspace" $script
+# A misconfigured run is multirun's own failure rather than the commands'.
+exit_code=0
+repository_output=$(env -u BUILD_WORKSPACE_DIRECTORY $script 2>&1) || exit_code=$?
+if [[ "$exit_code" != 125 || "$repository_output" != "error: 'repositories' requires BUILD_WORKSPACE_DIRECTORY"* ]]; then
+  echo "Expected repositories without a workspace to fail with 125, got $exit_code: '$repository_output'"
+  exit 1
+fi
+
+for policy_and_code in first_failure:3 highest:5 count:2 serial:3; do
+  policy="${policy_and_code%:*}"
+  expected="${policy_and_code#*:}"
+  script=$(rlocation "rules_multirun/tests/multirun_exit_code_$policy.bash")
+  exit_code=0
+  $script > /dev/null || exit_code=$?
+  if [[ "$exit_code" != "$expected" ]]; then
+    echo "Expected exit code $expected with the $policy policy, got $exit_code"
+    exit 1
+  fi
+done
+
+script=$(rlocation rules_multirun/tests/multirun_exit_code_count.bash)
+exit_code=0
+MULTIRUN_EXIT_CODE_POLICY=highest $script > /dev/null || exit_code=$?
+if [[ "$exit_code" != 5 ]]; then
+  echo "Expected MULTIRUN_EXIT_CODE_POLICY to override exit_code_policy, got $exit_code"
+  exit 1
+fi
+
+# Commands that can't be run are all reported before anything runs.
+runner=$(rlocation rules_multirun/internal/multirun)
+instructions_json print_command=true > "$TEST_TMPDIR/unrunnable.json" <<EOF
+  {"tag": "hello", "path": "tests/echo_hello.sh", "args": [], "env": {}},
+  {"tag": "missing", "path": "tests/missing.sh", "args": [], "env": {}},
+  {"tag": "not executable", "path": "tests/not-executable.sh", "args": [], "env": {}}
+EOF
+exit_code=0
+unrunnable_output=$($runner "$TEST_TMPDIR/unrunnable.json" 2>&1) || exit_code=$?
+if [[ "$exit_code" != 125 \
+  || "$unrunnable_output" == *"hello"* \
+  || "$unrunnable_output" != *"'missing': tests/missing.sh "*"looked up rules_multirun/tests/missing.sh in the runfiles "* \
+  || "$unrunnable_output" != *"'not executable': tests/not-executable.sh resolved to "*" which is not executable"* ]]; then
+  echo "Expected both unrunnable commands to be reported before running, got $exit_code: '$unrunnable_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_duplicate_tags.bash)
+duplicate_tags_output=$($script 2> "$TEST_TMPDIR/duplicate_tags.log")
+if [[ "$duplicate_tags_output" != "hello #1
+hello
+hello #2
+hello2" ]]; then
+  echo "Expected numbered tags, got '$duplicate_tags_output'"
+  exit 1
+fi
+if [[ "$(cat "$TEST_TMPDIR/duplicate_tags.log")" != *"warning: duplicate command tags, numbering them: 'hello'"* ]]; then
+  echo "Expected a warning about the duplicate tags, got '$(cat "$TEST_TMPDIR/duplicate_tags.log")'"
+  exit 1
+fi
+
+# Every parallel command gets a result, failed ones included, which the
+# buffered output, the results file and the exit code agree on.
+instructions_json jobs=0 print_command=true buffer_output=true exit_code_policy='"count"' > "$TEST_TMPDIR/results.json" <<EOF
+  {"tag": "exit 3", "path": "tests/exit-with.sh", "args": ["3"], "env": {}},
+  {"tag": "hello", "path": "tests/echo_hello.sh", "args": [], "env": {}},
+  {"tag": "exit 5", "path": "tests/exit-with.sh", "args": ["5"], "env": {}}
+EOF
+exit_code=0
+results="$TEST_TMPDIR/results.jsonl"
+results_output=$(MULTIRUN_RESULTS="jsonl:$results" $runner "$TEST_TMPDIR/results.json") || exit_code=$?
+if [[ "$exit_code" != 2 || "$results_output" != "exit 3
+hello
+hello
+exit 5" || "$(grep -c '"status": "failed"' "$results")" != 2 \
+  || "$(grep -c '"exit_code": 3,' "$results")" != 1 \
+  || "$(grep -c '"exit_code": 5,' "$results")" != 1 ]]; then
+  echo "Expected a result for every command, got $exit_code: '$results_output' '$(cat "$results")'"
+  exit 1
+fi
+
+# Interrupting parallel commands also stops the processes they started.
+children="$TEST_TMPDIR/interrupted-children"
+instructions_json jobs=0 > "$TEST_TMPDIR/interrupted.json" <<EOF
+  {"tag": "spawn child", "path": "tests/spawn-child.sh", "args": [], "env": {"CHILD_PIDS": "$children"}},
+  {"tag": "hello", "path": "tests/echo_hello.sh", "args": [], "env": {}}
+EOF
+# With job control the run gets its own process group that doesn't ignore
+# SIGINT.
+set -m
+$runner "$TEST_TMPDIR/interrupted.json" > /dev/null 2>&1 &
+runner_pid=$!
+set +m
+for _ in $(seq 100); do
+  [[ -s "$children" ]] && break
+  sleep 0.1
+done
+kill -INT -- -"$runner_pid"
+wait "$runner_pid" || true
+child_pid=$(cat "$children")
+expect_stopped "Expected interrupting the command to stop the processes it started" "$child_pid"
+
+# Commands that didn't run because another failed are reported as cancelled
+# and don't hide its exit code.
+instructions_json exit_code_policy='"highest"' > "$TEST_TMPDIR/cancelled.json" <<EOF
+  {"tag": "exit 3", "path": "tests/exit-with.sh", "args": ["3"], "env": {}},
+  {"tag": "hello", "path": "tests/echo_hello.sh", "args": [], "env": {}}
+EOF
+exit_code=0
+cancelled_output=$($runner "$TEST_TMPDIR/cancelled.json" 2>&1 > /dev/null) || exit_code=$?
+if [[ "$exit_code" != 3 \
+  || "$cancelled_output" != *"exit 3: failed with exit code 3"* \
+  || "$cancelled_output" != *"hello: cancelled"* ]]; then
+  echo "Expected the command that didn't run to be reported as cancelled, got $exit_code: '$cancelled_output'"
+  exit 1
+fi
+
+echo '{"workspace_name": "rules_multirun", "commands": []}' > "$TEST_TMPDIR/incomplete.json"
+exit_code=0
+incomplete_output=$($runner "$TEST_TMPDIR/incomplete.json" 2>&1) || exit_code=$?
+if [[ "$exit_code" != 125 || "$incomplete_output" != "error: invalid instructions in $TEST_TMPDIR/incomplete.json: missing 'jobs'" ]]; then
+  echo "Expected incomplete instructions to fail with 125, got $exit_code: '$incomplete_output'"
+  exit 1
+fi
+
+# Files the system can't execute fail to launch like they would in a shell.
+instructions_json > "$TEST_TMPDIR/no-shebang.json" <<EOF
+  {"tag": "no shebang", "path": "tests/no-shebang.sh", "args": [], "env": {}}
+EOF
+exit_code=0
+launch_output=$($runner "$TEST_TMPDIR/no-shebang.json" 2>&1) || exit_code=$?
+if [[ "$exit_code" != 126 || "$launch_output" != *"no shebang: failed to launch: "*"Exec format error"* ]]; then
+  echo "Expected a command that can't be executed to fail to launch with 126, got $exit_code: '$launch_output'"
+  exit 1
+fi
+
+# Versioned instructions reject fields this multirun doesn't know, and
+# versions newer than it.
+versioned="$TEST_TMPDIR/versioned.json"
+echo '{"version": 1, "workspace_name": "rules_multirun", "commands": [], "jobs": 1, "print_command": false, "keep_going": false, "buffer_output": false, "keepgoing": true}' > "$versioned"
+exit_code=0
+versioned_output=$($runner "$versioned" 2>&1) || exit_code=$?
+if [[ "$exit_code" != 125 || "$versioned_output" != "error: unknown fields in $versioned: 'keepgoing'" ]]; then
+  echo "Expected an unknown field to fail with 125, got $exit_code: '$versioned_output'"
+  exit 1
+fi
+echo '{"version": 1, "workspace_name": "rules_multirun", "commands": [{"tag": "a", "path": "tests/echo_hello.sh", "args": [], "env": {}, "tmeout": 3}], "jobs": 1, "print_command": false, "keep_going": false, "buffer_output": false}' > "$versioned"
+exit_code=0
+versioned_output=$($runner "$versioned" 2>&1) || exit_code=$?
+if [[ "$exit_code" != 125 || "$versioned_output" != "error: unknown fields in $versioned: 'tmeout' in commands[0]" ]]; then
+  echo "Expected an unknown command field to fail with 125, got $exit_code: '$versioned_output'"
+  exit 1
+fi
+for version in 2 '"1"'; do
+  echo '{"version": '"$version"', "workspace_name": "rules_multirun", "commands": [], "jobs": 1, "print_command": false, "keep_going": false, "buffer_output": false}' > "$versioned"
+  exit_code=0
+  versioned_output=$($runner "$versioned" 2>&1) || exit_code=$?
+  if [[ "$exit_code" != 125 || "$versioned_output" != "error: unsupported instructions version $version in $versioned"* ]]; then
+    echo "Expected version $version to fail with 125, got $exit_code: '$versioned_output'"
+    exit 1
+  fi
+done
+
+script=$(rlocation rules_multirun/tests/multirun_empty_fail.bash)
+exit_code=0
+$script 2> /dev/null || exit_code=$?
+if [[ "$exit_code" != 125 ]]; then
+  echo "Expected an empty multirun to fail with 125, got $exit_code"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_parallel_stdin.bash)
+stdin_output=$(echo input | $script)
+if [[ "$stdin_output" != "read 'input'
+no input" ]]; then
+  echo "Expected only one command to read stdin, got '$stdin_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_killed_by_signal.bash)
+exit_code=0
+signal_output=$($script 2>&1) || exit_code=$?
+if [[ "$exit_code" != 138 || "$signal_output" != *"killed: killed by SIGUSR1"* ]]; then
+  echo "Expected the signal that killed the command to be named, got $exit_code: '$signal_output'"
+  exit 1
+fi
+
+# Commands whose interpreters can't be found are all reported before
+# anything runs.
+instructions_json > "$TEST_TMPDIR/preflight.json" <<EOF
+  {"tag": "interpreter", "path": "tests/bad-interpreter.sh", "args": [], "env": {}},
+  {"tag": "env", "path": "tests/bad-env.sh", "args": [], "env": {}}
+EOF
+exit_code=0
+preflight_output=$($runner "$TEST_TMPDIR/preflight.json" 2>&1) || exit_code=$?
+if [[ "$exit_code" != 125 || "$preflight_output" != "error: commands can't be run:
+'interpreter': interpreter /no/such/interpreter not found or not executable
+'env': interpreter no-such-interpreter not found in PATH" ]]; then
+  echo "Expected both missing interpreters to be reported, got $exit_code: '$preflight_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_unicode_tag.bash)
+unicode_output=$($script)
+if [[ "$unicode_output" != "café 🚀 漢字
+hello" ]]; then
+  echo "Expected unicode tag, got '$unicode_output'"
+  exit 1
+fi
+
+# Every mode reports failures the same way.
+for mode in serial parallel parallel_buffered bounded; do
+  script=$(rlocation "rules_multirun/tests/multirun_failure_$mode.bash")
+  exit_code=0
+  failure_output=$($script 2> /dev/null) || exit_code=$?
+  if [[ "$exit_code" != 1 ]]; then
+    echo "Expected exit code 1 in $mode mode, got $exit_code"
+    exit 1
+  fi
+  if [[ "$failure_output" != *"hello and fail"* ]]; then
+    echo "Expected the failing command's output in $mode mode, got '$failure_output'"
+    exit 1
+  fi
+done
+
+# Parallel commands run to completion, and the ones that failed are listed
+# at the end.
+for mode in parallel parallel_buffered bounded; do
+  script=$(rlocation "rules_multirun/tests/multirun_failure_$mode.bash")
+  $script > "$TEST_TMPDIR/failure.out" 2> "$TEST_TMPDIR/failure.err" || true
+  if ! grep -q '^hello$' "$TEST_TMPDIR/failure.out"; then
+    echo "Expected the other command to run to completion in $mode mode, got '$(cat "$TEST_TMPDIR/failure.out")'"
+    exit 1
+  fi
+  if ! grep -q '1 of 2 commands did not succeed' "$TEST_TMPDIR/failure.err" || ! grep -q 'echo_and_fail_cmd: failed with exit code 1' "$TEST_TMPDIR/failure.err"; then
+    echo "Expected the failed command to be listed in $mode mode, got '$(cat "$TEST_TMPDIR/failure.err")'"
+    exit 1
+  fi
+done
+
+script=$(rlocation rules_multirun/tests/multirun_environment.bash)
+$script
+
+script=$(rlocation rules_multirun/tests/multirun_environment_precedence.bash)
+$script
+
+script=$(rlocation rules_multirun/tests/multirun_serial.bash)
+instructions=$(rlocation rules_multirun/tests/multirun_serial.json)
+exit_code=0
+cycle_output=$(MULTIRUN_INSTRUCTIONS_STACK="$instructions" $script 2>&1) || exit_code=$?
+if [[ "$exit_code" != 125 || "$cycle_output" != *"multirun is running itself recursively"* ]]; then
+  echo "Expected a recursive multirun to fail with 125, got $exit_code: '$cycle_output'"
+  exit 1
+fi
+
+# A command that fails to launch stops the parallel commands already running,
+# and the processes they started.
+children="$TEST_TMPDIR/launch-failure-children"
+instructions_json jobs=0 > "$TEST_TMPDIR/launch-failure.json" <<EOF
+  {"tag": "spawn child", "path": "tests/spawn-child.sh", "args": [], "env": {"CHILD_PIDS": "$children"}},
+  {"tag": "no shebang", "path": "tests/no-shebang.sh", "args": [], "env": {}}
+EOF
+exit_code=0
+launch_failure_output=$($runner "$TEST_TMPDIR/launch-failure.json" 2>&1 > /dev/null) || exit_code=$?
+if [[ "$exit_code" != 126 || "$launch_failure_output" != *"spawn child: cancelled"* ]]; then
+  echo "Expected the failed launch to cancel the running command, got $exit_code: '$launch_failure_output'"
+  exit 1
+fi
+# The command may have been stopped before it started its child.
+expect_stopped "Expected cancelling the command to stop the processes it started" $(cat "$children" 2> /dev/null)
+
+# Instructions for a workspace that isn't in the runfiles fall back to the
+# main repository under Bzlmod, and fail otherwise.
+echo '{"workspace_name": "no_such_workspace", "jobs": 1, "print_command": false, "keep_going": false, "buffer_output": false, "commands": [{"tag": "hello", "path": "tests/echo_hello.sh", "args": [], "env": {}}]}' > "$TEST_TMPDIR/workspace.json"
+exit_code=0
+workspace_output=$($runner "$TEST_TMPDIR/workspace.json" 2>&1) || exit_code=$?
+if [[ -n "$(rlocation _main/tests/echo_hello.sh 2> /dev/null || true)" ]]; then
+  if [[ "$exit_code" != 0 || "$workspace_output" != "warning: workspace 'no_such_workspace' is not in the runfiles, using '_main' instead
+hello" ]]; then
+    echo "Expected the main repository to be used instead, got $exit_code: '$workspace_output'"
+    exit 1
+  fi
+elif [[ "$exit_code" != 125 || "$workspace_output" != "error: workspace 'no_such_workspace' is not in the runfiles, which contain: "*"rules_multirun"* ]]; then
+  echo "Expected a workspace that isn't in the runfiles to fail with 125, got $exit_code: '$workspace_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_tag_template.bash)
+tag_template_output=$($script)
+if [[ "$tag_template_output" != "tests:hello
+hello
+tests:hello2
+hello2" ]]; then
+  echo "Expected tags from the template, got '$tag_template_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_background.bash)
+start=$SECONDS
+background_output=$($script)
+if [[ "$background_output" != "hello" ]]; then
+  echo "Expected only the foreground command's output, got '$background_output'"
+  exit 1
+fi
+if (( SECONDS - start > 60 )); then
+  echo "Expected the background command to be stopped, took $((SECONDS - start))s"
+  exit 1
+fi
+
+# Background commands are told why they're stopped, and the processes they
+# started are stopped with them. Their output goes to a file, processes that
+# outlive them would keep a captured stdout open.
+script=$(rlocation rules_multirun/tests/multirun_background_teardown.bash)
+children="$TEST_TMPDIR/background-children"
+CHILD_PIDS="$children" $script > "$TEST_TMPDIR/background.log"
+if [[ "$(cat "$TEST_TMPDIR/background.log")" != "stopped: finished: the other commands finished" ]]; then
+  echo "Expected the background commands to be stopped once the others finished, got '$(cat "$TEST_TMPDIR/background.log")'"
+  exit 1
+fi
+child_pid=$(cat "$children")
+expect_stopped "Expected stopping the background command to stop the processes it started" "$child_pid"
+
+# The same happens when the other commands fail.
+script=$(rlocation rules_multirun/tests/multirun_background_teardown_failure.bash)
+children="$TEST_TMPDIR/background-failure-children"
+exit_code=0
+CHILD_PIDS="$children" $script > /dev/null 2>&1 || exit_code=$?
+if [[ "$exit_code" != 1 ]]; then
+  echo "Expected the other command's failure, got $exit_code"
+  exit 1
+fi
+child_pid=$(cat "$children")
+expect_stopped "Expected stopping the background command to stop the processes it started after a failure" "$child_pid"
+
+# With nothing else to run, background commands run until they exit, and
+# their failures fail the multirun.
+script=$(rlocation rules_multirun/tests/multirun_background_only.bash)
+background_only_output=$($script)
+if [[ "$background_only_output" != "hello" ]]; then
+  echo "Expected the background command to run until it exited, got '$background_only_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_background_only_failure.bash)
+exit_code=0
+$script > /dev/null 2>&1 || exit_code=$?
+if [[ "$exit_code" != 1 ]]; then
+  echo "Expected the background command's failure, got $exit_code"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_health.bash)
+health_output=$($script)
+if [[ "$health_output" != "HTTP/1.0 503 Service Unavailable
+HTTP/1.0 200 OK" ]]; then
+  echo "Expected health checks to be ready only after the pre commands, got '$health_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_print_command_details.bash)
+details_output=$($script)
+if [[ "$details_output" != *"  argv: "*" foo"* || "$details_output" != *"  cwd: "* ]]; then
+  echo "Expected the command's argv and cwd, got '$details_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_serial_description.bash)
+list_output=$(MULTIRUN_LIST=table $script)
+if [[ "$list_output" != "TAG"*"DESCRIPTION"*"LABEL"*"some custom string  some custom string  "*"//tests:validate_args_cmd_description"*"//tests:validate_env_cmd" ]]; then
+  echo "Expected a table of commands, got '$list_output'"
+  exit 1
+fi
+list_json_output=$(MULTIRUN_LIST=json $script)
+if [[ "$list_json_output" != *'"description": "some custom string"'* ]]; then
+  echo "Expected the commands as JSON, got '$list_json_output'"
+  exit 1
+fi
+script=$(rlocation rules_multirun/tests/multirun_unicode_list.bash)
+# Without the labels, which differ between Bazel versions.
+unicode_list_output=$(MULTIRUN_LIST=table $script | sed 's/ *[^ ]*$//')
+if [[ "$unicode_list_output" != "TAG           DESCRIPTION
+café 🚀 漢字  café 🚀 漢字
+café          café" ]]; then
+  echo "Expected wide and combining characters to line up, got '$unicode_list_output'"
+  exit 1
+fi
+# Arguments are the commands', even ones that look like multirun's flags.
+script=$(rlocation rules_multirun/tests/multirun_echo_args.bash)
+echo_args_output=$($script --list)
+if [[ "$echo_args_output" != "--list" ]]; then
+  echo "Expected --list to be passed to the command, got '$echo_args_output'"
+  exit 1
+fi
+
+# Post commands run even though the main command failed.
+script=$(rlocation rules_multirun/tests/multirun_phases.bash)
+exit_code=0
+phases_output=$($script 2> /dev/null) || exit_code=$?
+if [[ "$exit_code" != 1 || "$phases_output" != "hello
+hello and fail
+hello2" ]]; then
+  echo "Expected pre, main, and post commands to run in order, got $exit_code: '$phases_output'"
+  exit 1
+fi
+
+# A failing pre command skips the main commands but not the post commands.
+script=$(rlocation rules_multirun/tests/multirun_pre_commands_failure.bash)
+exit_code=0
+pre_failure_output=$($script 2> /dev/null) || exit_code=$?
+if [[ "$exit_code" != 1 || "$pre_failure_output" != "hello and fail
+hello2" ]]; then
+  echo "Expected the main commands to be skipped, got $exit_code: '$pre_failure_output'"
+  exit 1
+fi
+
+# Post commands also run when the main commands are interrupted, whether by
+# SIGINT or SIGTERM.
+script=$(rlocation rules_multirun/tests/multirun_post_commands_interrupted.bash)
+for signal in INT TERM; do
+  interrupted_log="$TEST_TMPDIR/post-commands-$signal.log"
+  # With job control the run gets its own process group that doesn't ignore
+  # SIGINT.
+  set -m
+  $script > "$interrupted_log" 2> /dev/null &
+  interrupted_pid=$!
+  set +m
+  for _ in $(seq 100); do
+    grep -q "^hello$" "$interrupted_log" && break
+    sleep 0.1
+  done
+  # Give the main command time to start.
+  sleep 0.5
+  kill -"$signal" -- -"$interrupted_pid"
+  exit_code=0
+  wait "$interrupted_pid" || exit_code=$?
+  if [[ "$exit_code" == 0 || "$(cat "$interrupted_log")" != "hello
+hello2" ]]; then
+    echo "Expected the post command to run after SIG$signal, got $exit_code: '$(cat "$interrupted_log")'"
+    exit 1
+  fi
+done
+
+# And when the run hits its deadline. The output goes to a file, the
+# processes the stopped command started could keep a captured stdout open.
+script=$(rlocation rules_multirun/tests/multirun_post_commands_deadline.bash)
+exit_code=0
+$script > "$TEST_TMPDIR/post-commands-deadline.log" 2> /dev/null || exit_code=$?
+if [[ "$exit_code" != 124 || "$(cat "$TEST_TMPDIR/post-commands-deadline.log")" != "hello
+hello2" ]]; then
+  echo "Expected the post command to run after the deadline, got $exit_code: '$(cat "$TEST_TMPDIR/post-commands-deadline.log")'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_fragments.bash)
+fragments_output=$($script)
+if [[ "$fragments_output" != "hello2
+hello" ]]; then
+  echo "Expected the fragment's command to run after the multirun's own, got '$fragments_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_over_budget.bash)
+exit_code=0
+budget_output=$($script 2>&1) || exit_code=$?
+if [[ "$exit_code" != 1 || "$budget_output" != *"over its budget of 1.0s"* ]]; then
+  echo "Expected the command to fail for taking too long, got $exit_code: '$budget_output'"
+  exit 1
+fi
+
+action_output=$(cat "$(rlocation rules_multirun/tests/multirun_in_action.txt)")
+if [[ "$action_output" != "hello
+hello2" ]]; then
+  echo "Expected the multirun to run in a build action, got '$action_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_hello_no_print.bash)
+only_output=$(MULTIRUN_ONLY=hello2 $script)
+if [[ "$only_output" != "hello2" ]]; then
+  echo "Expected MULTIRUN_ONLY to select one command, got '$only_output'"
+  exit 1
+fi
+
+skip_output=$(MULTIRUN_SKIP='*2' $script)
+if [[ "$skip_output" != "hello" ]]; then
+  echo "Expected MULTIRUN_SKIP to skip one command, got '$skip_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_serial_description.bash)
+quiet_output=$(MULTIRUN_QUIET=1 $script)
+if [[ -n "$quiet_output" ]]; then
+  echo "Expected MULTIRUN_QUIET to hide the tags, got '$quiet_output'"
+  exit 1
+fi
+
+exit_code=0
+MULTIRUN_JOBS=some $script 2> /dev/null || exit_code=$?
+if [[ "$exit_code" != 125 ]]; then
+  echo "Expected an invalid MULTIRUN_JOBS to fail with 125, got $exit_code"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_over_budget.bash)
+exit_code=0
+timeout_output=$(MULTIRUN_TIMEOUT=0.5 $script 2>&1) || exit_code=$?
+if [[ "$exit_code" != 1 || "$timeout_output" != *"timed out after"* ]]; then
+  echo "Expected MULTIRUN_TIMEOUT to kill the command, got $exit_code: '$timeout_output'"
+  exit 1
+fi
+
+# Under ibazel the commands run again after every successful build.
+script=$(rlocation rules_multirun/tests/multirun_hello_no_print.bash)
+ibazel_output=$( (sleep 2; echo IBAZEL_BUILD_STARTED; echo IBAZEL_BUILD_COMPLETED SUCCESS) | IBAZEL_NOTIFY_CHANGES=y $script)
+if [[ "$ibazel_output" != "hello
+hello2
+hello
+hello2" ]]; then
+  echo "Expected the commands to run again after the rebuild, got '$ibazel_output'"
+  exit 1
+fi
+
+# Restarting a command under ibazel also stops the processes it started,
+# even when it runs alone.
+script=$(rlocation rules_multirun/tests/multirun_spawn_child.bash)
+children="$TEST_TMPDIR/children"
+(
+  for _ in $(seq 100); do
+    [[ -s "$children" ]] && break
+    sleep 0.1
+  done
+  echo IBAZEL_BUILD_STARTED
+  echo IBAZEL_BUILD_COMPLETED SUCCESS
+  for _ in $(seq 100); do
+    [[ $(wc -l < "$children") -ge 2 ]] && break
+    sleep 0.1
+  done
+) | CHILD_PIDS="$children" IBAZEL_NOTIFY_CHANGES=y $script > /dev/null &
+ibazel_pid=$!
+for _ in $(seq 100); do
+  [[ -f "$children" && $(wc -l < "$children") -ge 2 ]] && break
+  sleep 0.1
+done
+stale_pid=$(head -n 1 "$children")
+for _ in $(seq 50); do
+  kill -0 "$stale_pid" 2> /dev/null || break
+  sleep 0.1
+done
+kill -TERM "$ibazel_pid"
+wait "$ibazel_pid" || true
+if [[ $(wc -l < "$children") -lt 2 ]] || kill -0 "$stale_pid" 2> /dev/null; then
+  echo "Expected the restart to stop the processes the command started, got '$(cat "$children")'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_color.bash)
+color_output=$(CLICOLOR_FORCE=1 $script)
+if [[ "$color_output" != $'\e[1mcolor\e[0m\n1' ]]; then
+  echo "Expected a colored tag and FORCE_COLOR for the command, got '$color_output'"
+  exit 1
+fi
+no_color_output=$(NO_COLOR=1 CLICOLOR_FORCE=1 $script)
+if [[ "$no_color_output" != "color" ]]; then
+  echo "Expected NO_COLOR to turn off colors, got '$no_color_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_resize.bash)
+$script > "$TEST_TMPDIR/resize.out" &
+resize_pid=$!
+for _ in $(seq 100); do
+  [[ -f "$TEST_TMPDIR/resize.ready" ]] && break
+  sleep 0.1
+done
+kill -WINCH "$resize_pid"
+exit_code=0
+wait "$resize_pid" || exit_code=$?
+if [[ "$exit_code" != 0 || "$(cat "$TEST_TMPDIR/resize.out")" != "resized" ]]; then
+  echo "Expected the command in its own session to be told about the resize, got $exit_code: '$(cat "$TEST_TMPDIR/resize.out")'"
+  exit 1
+fi
+
+# system_log logs the run and its failures, a sitecustomize replaces syslog
+# to see what was logged.
+mkdir -p "$TEST_TMPDIR/fake_syslog"
+cat > "$TEST_TMPDIR/fake_syslog/sitecustomize.py" <<EOF
+import sys
+import types
+
+syslog = types.ModuleType("syslog")
+syslog.LOG_PID, syslog.LOG_USER = 0, 0
+syslog.LOG_INFO, syslog.LOG_WARNING, syslog.LOG_ERR = "info", "warning", "error"
+syslog.openlog = lambda *args: None
+
+
+def _syslog(priority, message):
+    with open("$TEST_TMPDIR/syslog", "a") as f:
+        f.write(f"{priority} {message}\n")
+
+
+syslog.syslog = _syslog
+sys.modules["syslog"] = syslog
+EOF
+script=$(rlocation rules_multirun/tests/multirun_system_log.bash)
+PYTHONPATH="$TEST_TMPDIR/fake_syslog" $script > /dev/null 2>&1 || true
+system_log=$(cat "$TEST_TMPDIR/syslog")
+if [[ "$system_log" != "info "*"multirun_system_log: started 2 commands
+error "*"multirun_system_log: '"*"' failed with exit code 1
+warning "*"multirun_system_log: finished with exit code 1" ]]; then
+  echo "Expected the run and its failure in the system log, got '$system_log'"
+  exit 1
+fi
+
+# The runner can also be run directly with flags.
+instructions=$(rlocation rules_multirun/tests/multirun_hello_no_print.json)
+direct_output=$($runner --instructions="$instructions" --only=hello2 -- extra)
+if [[ "$direct_output" != "hello2" ]]; then
+  echo "Expected the runner to run the selected command, got '$direct_output'"
+  exit 1
+fi
+old_results="$TEST_TMPDIR/old.jsonl"
+new_results="$TEST_TMPDIR/new.jsonl"
+echo '{"tag": "a", "phase": "commands", "status": "succeeded", "exit_code": 0, "duration": 1.0, "attempts": 1}' > "$old_results"
+echo '{"tag": "b", "phase": "commands", "status": "failed", "exit_code": 1, "duration": 1.0, "attempts": 1}' >> "$old_results"
+echo '{"tag": "a", "phase": "commands", "status": "failed", "exit_code": 1, "duration": 1.0, "attempts": 1, "reason": "failed with exit code 1"}' > "$new_results"
+echo '{"tag": "b", "phase": "commands", "status": "succeeded", "exit_code": 0, "duration": 1.0, "attempts": 1}' >> "$new_results"
+exit_code=0
+compare_output=$($runner --compare "$old_results" "$new_results") || exit_code=$?
+if [[ "$exit_code" != 1 || "$compare_output" != *"newly failing:"*"a: failed with exit code 1"*"newly passing:"*"b"* ]]; then
+  echo "Expected the comparison to report a as newly failing and b as newly passing, got $exit_code '$compare_output'"
+  exit 1
+fi
+exit_code=0
+$runner --instructions=missing.json 2> /dev/null || exit_code=$?
+if [[ "$exit_code" != 125 ]]; then
+  echo "Expected a missing instructions file to fail with 125, got $exit_code"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_hello_no_print.bash)
+version_output=$(MULTIRUN_VERSION=1 $script)
+if [[ "$version_output" != "multirun "*"instructions schema version: 1"* ]]; then
+  echo "Expected the version instead of running the commands, got '$version_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_bounded_jobs.bash)
+bounded_jobs_output=$($script)
+if [[ "$bounded_jobs_output" != *2* || "$bounded_jobs_output" == *[3-9]* ]]; then
+  echo "Expected at most 2 commands to run at once, got '$bounded_jobs_output'"
+  exit 1
+fi
+# Every command runs, and as many of them run at once as MULTIRUN_JOBS
+# says when it overrides jobs.
+for jobs in 1 3; do
+  bounded_jobs_output=$(MULTIRUN_JOBS=$jobs $script)
+  if [[ "$(wc -l <<< "$bounded_jobs_output" | tr -d ' ')" != 4 \
+    || "$(sort -n <<< "$bounded_jobs_output" | tail -n 1)" != "$jobs" ]]; then
+    echo "Expected all 4 commands to run, at most $jobs at once, got '$bounded_jobs_output'"
+    exit 1
+  fi
+done
+
+script=$(rlocation rules_multirun/tests/multirun_resource_groups.bash)
+resource_groups_output=$($script)
+if [[ "$resource_groups_output" != *2* || "$resource_groups_output" == *[3-9]* ]]; then
+  echo "Expected at most 2 commands of the group to run at once, got '$resource_groups_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_group_jobs.bash)
+group_jobs_output=$($script)
+if [[ "$group_jobs_output" != *2* || "$group_jobs_output" == *[3-9]* ]]; then
+  echo "Expected at most 2 commands of the group to run at once, got '$group_jobs_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_stagger.bash)
+stagger_output=$($script)
+if [[ "$stagger_output" != $'1\n1\n1' ]]; then
+  echo "Expected staggered commands to start a second apart, got '$stagger_output'"
+  exit 1
+fi
+
+# Tags are only printed when commands run one at a time.
+script=$(rlocation rules_multirun/tests/multirun_max_jobs.bash)
+max_jobs_output=$(MULTIRUN_JOBS=0 $script 2> /dev/null)
+if [[ "$max_jobs_output" != "hello
+hello
+hello2
+hello2" ]]; then
+  echo "Expected max_jobs to limit MULTIRUN_JOBS, got '$max_jobs_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_over_budget.bash)
+timeout_output=$(MULTIRUN_TIMEOUT=60 MULTIRUN_TIMEOUT_SLEEP_OVER_BUDGET_CMD=0.5 $script 2>&1) || true
+if [[ "$timeout_output" != *"timed out after"* ]]; then
+  echo "Expected MULTIRUN_TIMEOUT_<NAME> to take precedence, got '$timeout_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_normalize_paths.bash)
+normalized_output=$($script)
+if [[ "$normalized_output" != "tests/print-path.sh" ]]; then
+  echo "Expected the runfiles path to be workspace relative, got '$normalized_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_output_slices.bash)
+slices_output=$($script)
+if [[ "$slices_output" != "slowly
+first
+slowly (continued)
+second" ]]; then
+  echo "Expected the output in slices, got '$slices_output'"
+  exit 1
+fi
+
+# Lines are printed as they're written, after the tag of their command.
+script=$(rlocation rules_multirun/tests/multirun_prefix_output.bash)
+prefix_output=$($script)
+if [[ "$(head -n 2 <<< "$prefix_output" | sort)" != "[hello] hello
+[slowly] first" || "$(tail -n 1 <<< "$prefix_output")" != "[slowly] second" ]]; then
+  echo "Expected the lines of both commands prefixed with their tags, got '$prefix_output'"
+  exit 1
+fi
+prefix_output=$(CLICOLOR_FORCE=1 $script)
+if [[ "$prefix_output" != *$'\e[1;36m[slowly]\e[0m first'* || "$prefix_output" != *$'\e[1;33m[hello]\e[0m hello'* ]]; then
+  echo "Expected each command's prefix in its own color, got '$prefix_output'"
+  exit 1
+fi
+
+# Every line is stamped with the time since the multirun started.
+script=$(rlocation rules_multirun/tests/multirun_timestamps.bash)
+timestamps_output=$($script)
+timestamps_pattern=$'^\\+[0-9]+\\.[0-9]{3}s first\n\\+[0-9]+\\.[0-9]{3}s second$'
+if [[ ! "$timestamps_output" =~ $timestamps_pattern ]]; then
+  echo "Expected every line with the time since the multirun started, got '$timestamps_output'"
+  exit 1
+fi
+
+# Each command's output is also written to a log named after its tag.
+script=$(rlocation rules_multirun/tests/multirun_log_dir.bash)
+log_outputs="$TEST_TMPDIR/log_outputs"
+log_output=$(TEST_UNDECLARED_OUTPUTS_DIR="$log_outputs" $script)
+if [[ "$(sort <<< "$log_output")" != "first
+hello
+second" ]]; then
+  echo "Expected the output on the terminal too, got '$log_output'"
+  exit 1
+fi
+if [[ "$(ls "$log_outputs/logs" | wc -l)" != 2 || "$(cat "$log_outputs"/logs/slowly-*.log)" != "first
+second" || "$(cat "$log_outputs"/logs/hello-*.log)" != "hello" ]]; then
+  echo "Expected a log of each command, got '$(ls "$log_outputs/logs")'"
+  exit 1
+fi
+
+# Only commands whose path_filters match a staged file run.
+repo="$TEST_TMPDIR/changed_files_repo"
+mkdir -p "$repo/src"
+git -C "$repo" init -q
+git -C "$repo" -c user.name=test -c user.email=test@example.com commit -q --allow-empty -m initial
+echo "print('hi')" > "$repo/src/main.py"
+echo "notes" > "$repo/README"
+git -C "$repo" add .
+script=$(rlocation rules_multirun/tests/multirun_changed_files.bash)
+changed_output=$(BUILD_WORKSPACE_DIRECTORY="$repo" $script)
+if [[ "$changed_output" != "py
+src/main.py" ]]; then
+  echo "Expected only the Python command to run on the staged Python file, got '$changed_output'"
+  exit 1
+fi
+
+workspace="$TEST_TMPDIR/env_file_workspace"
+mkdir -p "$workspace"
+script=$(rlocation rules_multirun/tests/multirun_env_file.bash)
+BUILD_WORKSPACE_DIRECTORY="$workspace" $script
+cat > "$workspace/.multirun.env" <<'ENV'
+# Local overrides
+export FOO_ENV="local"
+ENV
+env_file_output=$(BUILD_WORKSPACE_DIRECTORY="$workspace" $script 2>&1) || true
+if [[ "$env_file_output" != *"got 'local'"* ]]; then
+  echo "Expected the env file to override the command's environment, got '$env_file_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_export_output.bash)
+export_output=$($script)
+if [[ "$export_output" != "hello" ]]; then
+  echo "Expected the pre command's output to be exported to the command, got '$export_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_serial.bash)
+results="$TEST_TMPDIR/results.xml"
+MULTIRUN_RESULTS="junit:$results" $script > /dev/null
+if ! grep -q '<testsuite name="multirun" tests="2" failures="0" skipped="0"' "$results"; then
+  echo "Expected JUnit results for both commands, got '$(cat "$results")'"
+  exit 1
+fi
+results="$TEST_TMPDIR/report.html"
+MULTIRUN_RESULTS="html:$results" $script > /dev/null
+if ! grep -q '<h1>2 of 2 commands succeeded</h1>' "$results"; then
+  echo "Expected an HTML report for both commands, got '$(cat "$results")'"
+  exit 1
+fi
+
+# Tools that run multirun from Python can give it their own stream to print
+# to, which may not be able to encode everything commands print.
+multirun_py=$(rlocation rules_multirun/internal/multirun.py)
+runfiles_py=$(rlocation rules_python/python/runfiles/runfiles.py)
+injected_output=$(python3 - "$multirun_py" "$runfiles_py" <<'EOF'
+import io
+import os
+import sys
+
+multirun_py, runfiles_py = sys.argv[1:]
+# The runner's helpers are imported relative to the repository root.
+sys.path[:0] = [
+    os.path.dirname(multirun_py),
+    os.path.dirname(os.path.dirname(multirun_py)),
+    os.path.dirname(os.path.dirname(os.path.dirname(runfiles_py))),
+]
+import multirun
+
+stdout = io.TextIOWrapper(io.BytesIO(), encoding="ascii")
+command = multirun.Command(path="/bin/echo", tag="café", args=["naïve"], env={})
+options = multirun._options(
+    jobs=0,
+    command_count=1,
+    print_command=True,
+    print_details=False,
+    keep_going=False,
+    buffer_output=True,
+)._replace(stdout=stdout)
+multirun._perform([command], options)
+stdout.seek(0)
+print(stdout.read(), end="")
+EOF
+)
+if [[ "$injected_output" != $'caf?\nna?ve' ]]; then
+  echo "Expected the tag and output with what the stream can't encode replaced, got '$injected_output'"
+  exit 1
+fi
+
+progress=$(MULTIRUN_PROGRESS=3 $script 3>&1 > /dev/null)
+events=$(echo "$progress" | sed -E 's/^\{"event": "([a-z_]+)".*$/\1/' | tr '\n' ' ')
+if [[ "$events" != "run_started started finished started finished run_finished " ]]; then
+  echo "Expected progress records for the run and both commands on fd 3, got '$progress'"
+  exit 1
+fi
+
+# With MULTIRUN_EVENTS the records replace the output on stdout, with a
+# record for every line.
+script=$(rlocation rules_multirun/tests/multirun_timestamps.bash)
+events_output=$(MULTIRUN_EVENTS=jsonl $script)
+events=$(echo "$events_output" | sed -E 's/^\{"event": "([a-z_]+)".*$/\1/' | tr '\n' ' ')
+if [[ "$events" != "run_started started output output finished run_finished " || "$events_output" != *'"tag": "slowly", "phase": "commands", "line": "second"}'* ]]; then
+  echo "Expected progress records with the output on stdout, got '$events_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_hello_no_print.bash)
+cache="$TEST_TMPDIR/cache"
+mkdir -p "$cache/runs/999999999-killed"
+MULTIRUN_CACHE_DIR="$cache" $script > /dev/null
+clean_output=$(MULTIRUN_CACHE_DIR="$cache" MULTIRUN_CLEAN=1 $script)
+if [[ "$clean_output" != "Cleaned $cache" || -n "$(ls "$cache/runs")" ]]; then
+  echo "Expected cleaning to remove the directories of finished runs, got '$clean_output' and '$(ls "$cache/runs")'"
+  exit 1
+fi
+
+doctor_output=$(MULTIRUN_CACHE_DIR="$cache" MULTIRUN_DOCTOR=1 $script) || true
+if [[ "$doctor_output" != *"runfiles: "* || "$doctor_output" != *"commands: all commands resolve"* ]]; then
+  echo "Expected the doctor to check the runfiles and the commands, got '$doctor_output'"
+  exit 1
+fi
+# Outside of Windows commands run with their own interpreters, so bash
+# isn't needed.
+mkdir -p "$TEST_TMPDIR/no_bash"
+python=$(python3 -c 'import sys; print(sys.executable)')
+python_path="$(dirname "$(dirname "$multirun_py")"):$(dirname "$(dirname "$(dirname "$runfiles_py")")")"
+doctor_output=$(PATH="$TEST_TMPDIR/no_bash" PYTHONPATH="$python_path" "$python" "$multirun_py" --doctor) || true
+if [[ "$doctor_output" != *"info  bash: bash not found in PATH"* ]]; then
+  echo "Expected a missing bash not to be a problem, got '$doctor_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_inputs.bash)
+inputs_output=$(MULTIRUN_CACHE_DIR="$cache" $script)
+if [[ "$inputs_output" != *"hello"* ]]; then
+  echo "Expected the command to run the first time, got '$inputs_output'"
+  exit 1
+fi
+inputs_output=$(MULTIRUN_CACHE_DIR="$cache" $script)
+if [[ "$inputs_output" != *"(skipped, inputs unchanged since it last succeeded)" ]]; then
+  echo "Expected the command to be skipped when its inputs didn't change, got '$inputs_output'"
+  exit 1
+fi
+# Problems that don't stop the run are repeated in the summary.
+for inputs_file in "$cache"/inputs/*.json; do
+  echo "not json" > "$inputs_file"
+done
+inputs_output=$(MULTIRUN_CACHE_DIR="$cache" $script 2>&1)
+if [[ "$inputs_output" != *"hello"* || "$inputs_output" != *"multirun ran into problems"*$'\n'"  failed to read the inputs of earlier runs from "* ]]; then
+  echo "Expected the command to run and the unreadable inputs to be reported, got '$inputs_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_serial_keep_going.bash)
+MULTIRUN_CACHE_DIR="$cache" $script > /dev/null || true
+if failed_output=$(MULTIRUN_CACHE_DIR="$cache" MULTIRUN_FAILED=1 $script); then
+  echo "Expected the command that failed last time to fail again"
+  exit 1
+fi
+if [[ "$failed_output" != *"hello and fail"* || "$failed_output" == *"echo_hello"* ]]; then
+  echo "Expected only the command that failed last time to run, got '$failed_output'"
+  exit 1
+fi
+# Commands with duplicate tags are told apart by their numbers.
+instructions_json print_command=true keep_going=true on_duplicate_tags='"number"' > "$TEST_TMPDIR/duplicate_tags.json" <<EOF
+  {"tag": "exit", "path": "tests/exit-with.sh", "args": ["0"], "env": {}},
+  {"tag": "exit", "path": "tests/exit-with.sh", "args": ["1"], "env": {}}
+EOF
+MULTIRUN_CACHE_DIR="$cache" $runner --instructions="$TEST_TMPDIR/duplicate_tags.json" > /dev/null 2>&1 || true
+failed_output=$(MULTIRUN_CACHE_DIR="$cache" MULTIRUN_FAILED=1 $runner --instructions="$TEST_TMPDIR/duplicate_tags.json" 2> /dev/null) || true
+if [[ "$failed_output" != "exit #2" ]]; then
+  echo "Expected only the duplicate that failed last time to run, got '$failed_output'"
+  exit 1
+fi
+sed 's/"number"/"fail"/' "$TEST_TMPDIR/duplicate_tags.json" > "$TEST_TMPDIR/duplicate_tags_fail.json"
+exit_code=0
+duplicate_tags_output=$($runner --instructions="$TEST_TMPDIR/duplicate_tags_fail.json" 2>&1) || exit_code=$?
+if [[ "$exit_code" != 125 || "$duplicate_tags_output" != *"duplicate command tags: 'exit'"* ]]; then
+  echo "Expected duplicate tags to fail with 125, got $exit_code: '$duplicate_tags_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_resources.bash)
+if ! $script > /dev/null; then
+  echo "Expected commands using the same resource not to overlap"
+  exit 1
+fi
+script=$(rlocation rules_multirun/tests/multirun_mutex.bash)
+if ! $script > /dev/null; then
+  echo "Expected commands sharing a mutex not to overlap"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_timeout.bash)
+results="$TEST_TMPDIR/timeout.jsonl"
+timeout_output=$(MULTIRUN_RESULTS="jsonl:$results" $script 2> /dev/null) || true
+if [[ "$timeout_output" != *"stopped: timeout: ran longer than 1s"* ]]; then
+  echo "Expected the command to be sent SIGTERM when it timed out, got '$timeout_output'"
+  exit 1
+fi
+if ! grep -q '"status": "timed_out"' "$results"; then
+  echo "Expected the command to be reported as timed out, got '$(cat "$results")'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_timeout_children.bash)
+children="$TEST_TMPDIR/timed-out-children"
+CHILD_PIDS="$children" $script > /dev/null 2>&1 || true
+child_pid=$(cat "$children")
+expect_stopped "Expected timing out the command to stop the processes it started" "$child_pid"
+
+script=$(rlocation rules_multirun/tests/multirun_deadline.bash)
+deadline_exit_code=0
+deadline_output=$($script 2> /dev/null) || deadline_exit_code=$?
+if [[ "$deadline_exit_code" != 124 ]]; then
+  echo "Expected the run to exit with 124 when it passed its deadline, got $deadline_exit_code"
+  exit 1
+fi
+if [[ "$deadline_output" != *"stopped: deadline: the run took longer than 1s"* ]]; then
+  echo "Expected the command to be stopped at the deadline, got '$deadline_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_stop_on_error.bash)
+stop_on_error_output=$($script 2> /dev/null) || true
+if [[ "$stop_on_error_output" != *"stopped: failure: "*"failed with exit code 1"* ]]; then
+  echo "Expected the other commands to be stopped when one failed, got '$stop_on_error_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_stop_on_error_cancelled.bash)
+exit_code=0
+cancelled_output=$($script 2>&1 > /dev/null) || exit_code=$?
+if [[ "$exit_code" != 3 || "$cancelled_output" != *"forever: cancelled"* ]]; then
+  echo "Expected the stopped command to be reported as cancelled and the exit code of the failure, got $exit_code: '$cancelled_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_stop_on_error_children.bash)
+children="$TEST_TMPDIR/stopped-children"
+# The processes that outlive the command would keep a captured stdout open.
+CHILD_PIDS="$children" $script > /dev/null 2>&1 || true
+child_pid=$(cat "$children")
+expect_stopped "Expected stopping the command to stop the processes it started" "$child_pid"
+
+script=$(rlocation rules_multirun/tests/multirun_allow_failure.bash)
+if ! allow_failure_output=$($script 2>&1); then
+  echo "Expected a command allowed to fail not to fail the multirun, got '$allow_failure_output'"
+  exit 1
+fi
+if [[ "$allow_failure_output" != *"hello"*"failed with exit code 1 (allowed)"* ]]; then
+  echo "Expected the other commands to run and the failure to be reported as allowed, got '$allow_failure_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_auto_jobs.bash)
+auto_jobs_output=$($script | sort)
+if [[ "$auto_jobs_output" != $'hello\nhello2' ]]; then
+  echo "Expected every command to run with a job per CPU, got '$auto_jobs_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_priority.bash)
+priority_output=$($script)
+if [[ "$priority_output" != $'hello2\nhello' ]]; then
+  echo "Expected the command with the higher priority to run first, got '$priority_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_matrix.bash)
+matrix_output=$($script)
+if [[ "$matrix_output" != *"echo_args_matrix_cmd (env=dev, region=us)"$'\n'"us-dev"$'\n'*"echo_args_matrix_cmd (env=dev, region=eu)"$'\n'"eu-dev" ]]; then
+  echo "Expected a command for every combination of the matrix, got '$matrix_output'"
+  exit 1
+fi
+# Run by itself, the command takes the values from the matrix variables.
+script=$(rlocation rules_multirun/tests/echo_args_matrix_cmd.bash)
+matrix_output=$(MULTIRUN_MATRIX_ENV=prod MULTIRUN_MATRIX_REGION=eu $script)
+if [[ "$matrix_output" != "eu-prod" ]]; then
+  echo "Expected the command to use the matrix variables, got '$matrix_output'"
+  exit 1
+fi
+exit_code=0
+matrix_output=$($script 2>&1) || exit_code=$?
+if [[ "$exit_code" != 2 || "$matrix_output" != "set MULTIRUN_MATRIX_"*" to one of: "* ]]; then
+  echo "Expected the command to fail without the matrix variables, got $exit_code: '$matrix_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_shuffle.bash)
+shuffle_output=$(MULTIRUN_SHUFFLE_SEED=1 $script 2>&1)
+if [[ "$shuffle_output" != $'Shuffling commands with seed 1, MULTIRUN_SHUFFLE_SEED=1 runs them in the same order\nhello2\nhello' ]]; then
+  echo "Expected the seed to be printed and to decide the order, got '$shuffle_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_run_if.bash)
+run_if_output=$($script)
+if [[ "$run_if_output" != *"(skipped, run_if env:RUN_IF_TEST=1 doesn't hold)"*"hello2" ]]; then
+  echo "Expected the command to be skipped when its run_if condition doesn't hold, got '$run_if_output'"
+  exit 1
+fi
+run_if_output=$(RUN_IF_TEST=1 $script)
+if [[ "$run_if_output" == *"skipped"* || "$run_if_output" != *"hello"$'\n'*"hello2" ]]; then
+  echo "Expected the command to run when its run_if condition holds, got '$run_if_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_retries.bash)
+retries_output=$($script 2> /dev/null)
+if [[ "$retries_output" != *"flaky (attempt 3 of 3)"*"flaky success"* ]]; then
+  echo "Expected the flaky command to succeed on its third attempt, got '$retries_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_adaptive_jobs.bash)
+if ! $script > /dev/null 2>&1; then
+  echo "Expected commands that ran out of memory to succeed with fewer jobs"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_materialize_runfiles.bash)
+$script > /dev/null
+
+script=$(rlocation rules_multirun/tests/multirun_deps.bash)
+if ! $script > /dev/null; then
+  echo "Expected commands to wait for their dependencies"
+  exit 1
+fi
+
+rm "$TEST_TMPDIR/deps.marker"
+script=$(rlocation rules_multirun/tests/multirun_stages.bash)
+if ! $script > /dev/null; then
+  echo "Expected stages to run one after the other"
+  exit 1
+fi
+
+rm "$TEST_TMPDIR/deps.marker"
+script=$(rlocation rules_multirun/tests/multirun_ready_regex.bash)
+ready_output=$($script)
+if [[ "$ready_output" != "listening on 8080" ]]; then
+  echo "Expected commands to wait for the background command to be ready, got '$ready_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_never_ready.bash)
+start=$SECONDS
+if $script > /dev/null 2>&1; then
+  echo "Expected the run to fail when a background command is never ready"
+  exit 1
+fi
+if (( SECONDS - start > 60 )); then
+  echo "Expected the run to fail once the readiness timeout passed, took $((SECONDS - start))s"
+  exit 1
+fi
+# The output of background commands can go to a stream that only takes
+# text.
+serve=$(rlocation rules_multirun/tests/serve.sh)
+text_stream_output=$(python3 - "$multirun_py" "$python_path" "$serve" <<'EOF'
+import io
+import os
+import sys
+
+multirun_py, python_path, serve = sys.argv[1:]
+sys.path[:0] = [os.path.dirname(multirun_py)] + python_path.split(os.pathsep)
+import multirun
+
+stdout = io.StringIO()
+command = multirun.Command(path=serve, tag="serve", args=[], env={}, background=True, ready_regex="listening")
+multirun._stop_background(multirun._start_background([command], False, False, stdout))
+print(stdout.getvalue(), end="")
+EOF
+)
+rm "$TEST_TMPDIR/deps.marker"
+if [[ "$text_stream_output" != "listening on 8080" ]]; then
+  echo "Expected the background command's output in the text stream, got '$text_stream_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_pipeline.bash)
+pipeline_output=$($script)
+if [[ "$pipeline_output" != "HELLO" ]]; then
+  echo "Expected the first command's output to be piped into the second, got '$pipeline_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_wait_for.bash)
+wait_for_output=$($script)
+if [[ "$wait_for_output" != "hello" ]]; then
+  echo "Expected the command to run once its wait_for checks passed, got '$wait_for_output'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_wait_for_timeout.bash)
+if wait_for_output=$($script 2>&1); then
+  echo "Expected the command to fail when its wait_for checks never pass"
+  exit 1
+fi
+if [[ "$wait_for_output" != *"wait_for 'tcp:127.0.0.1:1' didn't pass within 1s"* || "$wait_for_output" == *"hello"* ]]; then
+  echo "Expected the command not to run when its wait_for checks never pass, got '$wait_for_output'"
+  exit 1
+fi
+# Checks that aren't strings are configuration errors.
+instructions_json > "$TEST_TMPDIR/wait_for_number.json" <<EOF
+  {"tag": "hello", "path": "tests/echo_hello.sh", "args": [], "env": {}, "wait_for": [8080]}
+EOF
+exit_code=0
+wait_for_output=$($runner --instructions="$TEST_TMPDIR/wait_for_number.json" 2>&1) || exit_code=$?
+if [[ "$exit_code" != 125 || "$wait_for_output" != *"'hello': invalid wait_for check '8080'"* ]]; then
+  echo "Expected a wait_for check that isn't a string to fail with 125, got $exit_code: '$wait_for_output'"
+  exit 1
+fi
+
+# A stack left running by a multirun that was killed can still be torn down.
+script=$(rlocation rules_multirun/tests/multirun_stack.bash)
+export MULTIRUN_CACHE_DIR="$TEST_TMPDIR/stack_cache"
+$script > /dev/null &
+stack_pid=$!
+for _ in $(seq 100); do
+  manifest=$(ls "$MULTIRUN_CACHE_DIR"/stacks/*.json 2> /dev/null || true)
+  if [[ -n "$manifest" && $(grep -c '"tag"' "$manifest") == 2 ]]; then
+    break
+  fi
+  sleep 0.1
+done
+service_pids=$(grep -o '"[0-9][0-9]*": {' "$manifest" | tr -dc '0-9\n')
+kill -9 "$stack_pid"
+wait "$stack_pid" 2> /dev/null || true
+down_output=$(MULTIRUN_DOWN=1 $script)
+if [[ "$down_output" != "Stopped "*" processes of "* ]]; then
+  echo "Expected the stack to be stopped, got '$down_output'"
+  exit 1
+fi
+expect_stopped "Expected the services to be stopped" $service_pids
+unset MULTIRUN_CACHE_DIR
+
+# Stopping a multirun with SIGTERM, like CI systems cancelling a job, stops
+# the commands it's running.
+script=$(rlocation rules_multirun/tests/multirun_stack.bash)
+export MULTIRUN_CACHE_DIR="$TEST_TMPDIR/terminate_cache"
+$script > /dev/null &
+stack_pid=$!
+for _ in $(seq 100); do
+  manifest=$(ls "$MULTIRUN_CACHE_DIR"/stacks/*.json 2> /dev/null || true)
+  if [[ -n "$manifest" && $(grep -c '"tag"' "$manifest") == 2 ]]; then
+    break
+  fi
+  sleep 0.1
+done
+service_pids=$(grep -o '"[0-9][0-9]*": {' "$manifest" | tr -dc '0-9\n')
+kill -TERM "$stack_pid"
+exit_code=0
+wait "$stack_pid" || exit_code=$?
+if [[ "$exit_code" != 1 ]]; then
+  echo "Expected the multirun to exit like it was interrupted, got $exit_code"
+  exit 1
+fi
+for pid in $service_pids; do
+  if kill -0 "$pid" 2> /dev/null; then
+    echo "Expected command $pid to be stopped with the multirun"
+    exit 1
+  fi
+done
+unset MULTIRUN_CACHE_DIR
+
+script=$(rlocation rules_multirun/tests/multirun_repeat.bash)
+repeat_log="$TEST_TMPDIR/repeat.log"
+$script > "$repeat_log" &
+repeat_pid=$!
+for _ in $(seq 100); do
+  if grep -q "^--- Run 2 at " "$repeat_log"; then
+    break
+  fi
+  sleep 0.1
+done
+kill -TERM "$repeat_pid"
+exit_code=0
+wait "$repeat_pid" || exit_code=$?
+if ! grep -q "^--- Run 2 at " "$repeat_log" || [[ $(grep -c "^hello$" "$repeat_log") -lt 2 ]]; then
+  echo "Expected the commands to run again after a divider, got '$(cat "$repeat_log")'"
+  exit 1
+fi
+if [[ "$exit_code" != 0 && "$exit_code" != 1 ]]; then
+  echo "Expected the repeated multirun to stop when terminated, got $exit_code"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_watch.bash)
+watched="$TEST_TMPDIR/watched"
+mkdir -p "$watched"
+echo one > "$watched/watched.txt"
+watch_log="$TEST_TMPDIR/watch.log"
+BUILD_WORKSPACE_DIRECTORY="$watched" $script > "$watch_log" &
+watch_pid=$!
+for _ in $(seq 100); do
+  if grep -q "^Watching 1 files for changes$" "$watch_log"; then
+    break
+  fi
+  sleep 0.1
+done
+echo two >> "$watched/watched.txt"
+for _ in $(seq 100); do
+  if [[ $(grep -c "^hello$" "$watch_log") -ge 2 ]]; then
+    break
+  fi
+  sleep 0.1
+done
+kill -TERM "$watch_pid"
+wait "$watch_pid" || true
+if ! grep -q "^Running again after changes to watched.txt$" "$watch_log" || [[ $(grep -c "^hello$" "$watch_log") -lt 2 ]]; then
+  echo "Expected the commands to run again after the watched file changed, got '$(cat "$watch_log")'"
+  exit 1
+fi
+
+script=$(rlocation rules_multirun/tests/multirun_locale.bash)
+locale_output=$(LANG=de_DE.UTF-8 LC_ALL=de_DE.UTF-8 TZ=Asia/Tokyo $script)
+if [[ "$locale_output" != "C.UTF-8 C.UTF-8 UTC
+C.UTF-8 C.UTF-8 America/New_York" ]]; then
+  echo "Expected the default locale and timezone and the commands' timezones, got '$locale_output'"
+  exit 1
+fi
+script=$(rlocation rules_multirun/tests/multirun_machine_locale.bash)
+machine_locale_output=$(LANG=de_DE.UTF-8 LC_ALL=de_DE.UTF-8 TZ=Asia/Tokyo $script)
+if [[ "$machine_locale_output" != "de_DE.UTF-8 de_DE.UTF-8 Asia/Tokyo" ]]; then
+  echo "Expected the machine's locale and timezone, got '$machine_locale_output'"
+  exit 1
+fi
+
+# run_as needs root, unless it's who multirun already runs as.
+run_as_json='{"workspace_name": "rules_multirun", "jobs": 1, "print_command": false, "keep_going": false, "buffer_output": false, "commands": [{"tag": "hello", "path": "tests/echo_hello.sh", "args": [], "env": {}, "run_as": "RUN_AS"}]}'
+echo "${run_as_json/RUN_AS/$(id -u):$(id -g)}" > "$TEST_TMPDIR/run_as.json"
+run_as_output=$($runner --instructions="$TEST_TMPDIR/run_as.json")
+if [[ "$run_as_output" != "hello" ]]; then
+  echo "Expected the command to run as the current user, got '$run_as_output'"
+  exit 1
+fi
+echo "${run_as_json/RUN_AS/no-such-user}" > "$TEST_TMPDIR/run_as.json"
+exit_code=0
+run_as_output=$($runner --instructions="$TEST_TMPDIR/run_as.json" 2>&1) || exit_code=$?
+if [[ "$exit_code" != 125 || "$run_as_output" != "error: commands can't be run:
+'hello': run_as user 'no-such-user' doesn't exist" ]]; then
+  echo "Expected a missing run_as user to fail with 125, got $exit_code: '$run_as_output'"
+  exit 1
+fi
+if [[ "$(id -u)" != 0 ]]; then
+  echo "${run_as_json/RUN_AS/$(($(id -u) + 1)):$(id -g)}" > "$TEST_TMPDIR/run_as.json"
+  exit_code=0
+  run_as_output=$($runner --instructions="$TEST_TMPDIR/run_as.json" 2>&1) || exit_code=$?
+  if [[ "$exit_code" != 125 || "$run_as_output" != "error: commands can't be run:
+'hello': run_as needs multirun to run as root" ]]; then
+    echo "Expected running as another user without root to fail with 125, got $exit_code: '$run_as_output'"
+    exit 1
+  fi
+fi
@@ -0,0 +1,9 @@
+#!/bin/bash
+
+set -euo pipefail
+
+# Says why it was stopped, which multirun writes before sending SIGTERM.
+trap 'kill "$sleep_pid" 2> /dev/null || true; echo "stopped: $(cat "$MULTIRUN_STOP_REASON_FILE")"; exit 1' TERM
+sleep 30 &
+sleep_pid=$!
+wait
@@ -0,0 +1,18 @@
+#!/bin/bash
+
+set -euo pipefail
+
+if [[ "$(basename "$PWD")" != "other" ]]; then
+  echo "error: expected to run in the 'other' checkout, got '$PWD'"
+  exit 1
+fi
+
+if [[ "$MULTIRUN_REPOSITORY" != "other" ]]; then
+  echo "error: expected MULTIRUN_REPOSITORY to be 'other', got '$MULTIRUN_REPOSITORY'"
+  exit 1
+fi
+
+if [[ "$(cd "$BUILD_WORKSPACE_DIRECTORY" && pwd -P)" != "$(pwd -P)" ]]; then
+  echo "error: expected BUILD_WORKSPACE_DIRECTORY to be '$PWD', got '$BUILD_WORKSPACE_DIRECTORY'"
+  exit 1
+fi
@@ -0,0 +1,12 @@
+#!/bin/bash
+
+set -euo pipefail
+
+if [[ -n "${RUNFILES_MANIFEST_FILE:-}" ]]; then
+  echo "error: expected no runfiles manifest, got '$RUNFILES_MANIFEST_FILE'"
+  exit 1
+fi
+if [[ ! -f "$RUNFILES_DIR/bazel_tools/tools/bash/runfiles/runfiles.bash" ]]; then
+  echo "error: expected a runfiles directory, got '$RUNFILES_DIR'"
+  exit 1
+fi
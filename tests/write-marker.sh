@@ -0,0 +1,7 @@
+#!/bin/bash
+
+set -euo pipefail
+
+# Takes a while so commands that don't wait for it would miss the marker.
+sleep 0.5
+touch "$TEST_TMPDIR/deps.marker"